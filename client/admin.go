@@ -0,0 +1,173 @@
+package client
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/MorElf7/GoMQ/utils"
+)
+
+// Admin commands go through the producer session, producers act as the
+// admins of the broker
+
+// List the durable subscriptions of a topic with their position and lag, or
+// of every topic if topic is empty
+func (p *Producer) ListSubscriptions(brokerAdr, topic string) ([]utils.SubscriptionInfo, error) {
+	resp, err := p.admin(brokerAdr, &utils.AdminRequest{
+		Command: utils.AdminListSubscriptions,
+		Topic:   topic,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Subscriptions, nil
+}
+
+// Move a durable subscription to the given offset. Fails if a consumer is
+// connected to the subscription.
+func (p *Producer) ResetSubscription(brokerAdr, topic, subscription string, offset uint64) error {
+	_, err := p.admin(brokerAdr, &utils.AdminRequest{
+		Command:      utils.AdminResetSubscription,
+		Topic:        topic,
+		Subscription: subscription,
+		Offset:       offset,
+	})
+	return err
+}
+
+// Delete a durable subscription. Fails if a consumer is connected to the
+// subscription.
+func (p *Producer) DeleteSubscription(brokerAdr, topic, subscription string) error {
+	_, err := p.admin(brokerAdr, &utils.AdminRequest{
+		Command:      utils.AdminDeleteSubscription,
+		Topic:        topic,
+		Subscription: subscription,
+	})
+	return err
+}
+
+// Get the config of a topic
+func (p *Producer) TopicConfig(brokerAdr, topic string) (*utils.TopicConfig, error) {
+	resp, err := p.admin(brokerAdr, &utils.AdminRequest{
+		Command: utils.AdminGetTopicConfig,
+		Topic:   topic,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Config, nil
+}
+
+// Set the config of a topic, the topic is created if it does not exist
+func (p *Producer) SetTopicConfig(brokerAdr, topic string, config utils.TopicConfig) error {
+	_, err := p.admin(brokerAdr, &utils.AdminRequest{
+		Command: utils.AdminSetTopicConfig,
+		Topic:   topic,
+		Config:  &config,
+	})
+	return err
+}
+
+// Publish the messages of a dead letter topic back to the topics they failed
+// on. Each message is re-driven once, the next call only re-drives the
+// messages dead lettered since. Return the number of messages re-driven.
+func (p *Producer) Redrive(brokerAdr, deadLetterTopic string) (int, error) {
+	resp, err := p.admin(brokerAdr, &utils.AdminRequest{
+		Command: utils.AdminRedrive,
+		Topic:   deadLetterTopic,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Count, nil
+}
+
+// Get the counters of a topic, or of every topic if topic is empty
+func (p *Producer) TopicStats(brokerAdr, topic string) ([]utils.TopicStats, error) {
+	resp, err := p.admin(brokerAdr, &utils.AdminRequest{
+		Command: utils.AdminTopicStats,
+		Topic:   topic,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Stats, nil
+}
+
+// List the namespaces holding topics with their number of topics. Namespace
+// commands take admin rights on every topic.
+func (p *Producer) ListNamespaces(brokerAdr string) ([]utils.NamespaceInfo, error) {
+	resp, err := p.admin(brokerAdr, &utils.AdminRequest{
+		Command: utils.AdminListNamespaces,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Namespaces, nil
+}
+
+// Write a badger backup of the topics, messages and subscriptions of a
+// namespace to w. The backup is streamed in chunks as the broker reads it,
+// so it can be larger than a frame.
+func (p *Producer) ExportNamespace(brokerAdr, namespace string, w io.Writer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.openSession(brokerAdr); err != nil {
+		return err
+	}
+	err := utils.WriteGobFrame(p.Conn, utils.FrameAdmin, &utils.AdminRequest{
+		Command:   utils.AdminExportNamespace,
+		Namespace: namespace,
+	})
+	if err != nil {
+		p.Logger.Error(err.Error())
+		p.closeSession()
+		return err
+	}
+
+	for {
+		frame, err := p.ReadBrokerFrame(p.reader)
+		if err != nil {
+			if _, ok := err.(*utils.ErrorMessage); !ok {
+				p.closeSession()
+			}
+			return err
+		}
+		switch frame.Type {
+		case utils.FrameExportChunk:
+			if _, err := w.Write(frame.Payload); err != nil {
+				// The rest of the export is still on its way
+				p.closeSession()
+				return err
+			}
+		case utils.FrameAdminResponse:
+			return nil
+		default:
+			p.closeSession()
+			return fmt.Errorf("%w: %d", utils.ErrUnexpectedFrame, frame.Type)
+		}
+	}
+}
+
+// Delete every topic of a namespace with its messages and subscriptions.
+// Fails if a consumer is connected to one of the topics.
+func (p *Producer) DeleteNamespace(brokerAdr, namespace string) error {
+	_, err := p.admin(brokerAdr, &utils.AdminRequest{
+		Command:   utils.AdminDeleteNamespace,
+		Namespace: namespace,
+	})
+	return err
+}
+
+func (p *Producer) admin(brokerAdr string, req *utils.AdminRequest) (*utils.AdminResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var resp utils.AdminResponse
+	err := p.roundTrip(brokerAdr, utils.FrameAdmin, req, utils.FrameAdminResponse, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
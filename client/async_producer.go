@@ -0,0 +1,370 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/MorElf7/GoMQ/utils"
+)
+
+var ErrProducerClosed = errors.New("producer is closed")
+
+type AsyncProducerConfig struct {
+	BatchSize  int           // Flush a topic batch once it holds this many messages
+	BatchBytes int           // Flush a topic batch once its content reaches this many bytes
+	Linger     time.Duration // Max time a message waits in a batch before the batch is flushed
+}
+
+var DefaultAsyncProducerConfig = AsyncProducerConfig{
+	BatchSize:  500,
+	BatchBytes: 1024 * 1024,
+	Linger:     10 * time.Millisecond,
+}
+
+// Result of an asynchronous publish, resolved once the broker acked or
+// rejected the batch holding the message
+type PublishFuture struct {
+	done     chan struct{}
+	ack      *utils.PublishAck
+	err      error
+	callback func(*utils.PublishAck, error)
+}
+
+// Block until the message is stored by the broker or failed
+func (f *PublishFuture) Wait() (*utils.PublishAck, error) {
+	<-f.done
+	return f.ack, f.err
+}
+
+// Closed once the future is resolved
+func (f *PublishFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+func (f *PublishFuture) resolve(ack *utils.PublishAck, err error) {
+	f.ack = ack
+	f.err = err
+	close(f.done)
+	if f.callback != nil {
+		f.callback(ack, err)
+	}
+}
+
+// Messages of one topic waiting to be flushed
+type topicBatch struct {
+	topic    string
+	messages []*utils.HLCMsg
+	futures  []*PublishFuture
+	bytes    int
+	timer    *time.Timer
+}
+
+func (b *topicBatch) fail(err error) {
+	for _, f := range b.futures {
+		f.resolve(nil, err)
+	}
+}
+
+// Connection to the broker with the batches sent on it and waiting for an ack,
+// the broker answers batches in the order they were sent
+type asyncSession struct {
+	conn    net.Conn
+	mu      sync.Mutex
+	pending []*topicBatch
+	broken  bool
+	err     error
+}
+
+// Mark the session as broken and fail every batch still waiting for an ack
+func (s *asyncSession) fail(err error) {
+	s.mu.Lock()
+	if !s.broken {
+		s.broken = true
+		s.err = err
+		s.conn.Close()
+	}
+	pending := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	for _, b := range pending {
+		b.fail(err)
+	}
+}
+
+func (s *asyncSession) popPending() *topicBatch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.pending) == 0 {
+		return nil
+	}
+	b := s.pending[0]
+	s.pending = s.pending[1:]
+	return b
+}
+
+type AsyncProducer struct {
+	Client
+	Clock     *utils.HLC
+	Config    AsyncProducerConfig
+	brokerAdr string
+	mu        sync.Mutex             // Guard batches and closed
+	batches   map[string]*topicBatch // Map of topic to the batch being filled
+	closed    bool
+	sendMu    sync.Mutex // One batch written at a time, guard session
+	session   *asyncSession
+}
+
+func NewAsyncProducer(brokerAdr string, config AsyncProducerConfig) *AsyncProducer {
+	filePath := "./log-producer.txt"
+
+	l := utils.NewLogger(filePath)
+
+	if config.BatchSize <= 0 {
+		config.BatchSize = DefaultAsyncProducerConfig.BatchSize
+	}
+	if config.BatchBytes <= 0 {
+		config.BatchBytes = DefaultAsyncProducerConfig.BatchBytes
+	}
+	if config.Linger <= 0 {
+		config.Linger = DefaultAsyncProducerConfig.Linger
+	}
+
+	return &AsyncProducer{
+		Clock:     utils.NewHLC(),
+		Config:    config,
+		brokerAdr: brokerAdr,
+		batches:   make(map[string]*topicBatch),
+		Client: Client{
+			Logger:       l,
+			MaxFrameSize: utils.DefaultMaxFrameSize,
+		},
+	}
+}
+
+// Queue a message for publishing and return straight away. The message is
+// sent with the next batch of its topic, the returned future and the optional
+// callback are resolved with the broker ack or the error.
+func (p *AsyncProducer) PublishAsync(topic, message string, callback func(*utils.PublishAck, error)) *PublishFuture {
+	return p.PublishMessageAsync(topic, &utils.HLCMsg{Body: []byte(message)}, callback)
+}
+
+// Queue a message with any of its fields set, as PublishAsync does. The
+// producer sets its timestamp.
+func (p *AsyncProducer) PublishMessageAsync(topic string, message *utils.HLCMsg, callback func(*utils.PublishAck, error)) *PublishFuture {
+	future := &PublishFuture{
+		done:     make(chan struct{}),
+		callback: callback,
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		future.resolve(nil, ErrProducerClosed)
+		return future
+	}
+
+	physical, logical := p.Clock.Now()
+	batch, exists := p.batches[topic]
+	if !exists {
+		batch = &topicBatch{topic: topic}
+		batch.timer = time.AfterFunc(p.Config.Linger, func() {
+			p.flushBatch(batch)
+		})
+		p.batches[topic] = batch
+	}
+	message.Physical, message.Logical = physical, logical
+	batch.messages = append(batch.messages, message)
+	batch.futures = append(batch.futures, future)
+	batch.bytes += len(message.Body)
+
+	full := len(batch.messages) >= p.Config.BatchSize || batch.bytes >= p.Config.BatchBytes
+	if full {
+		batch.timer.Stop()
+		delete(p.batches, topic)
+	}
+	p.mu.Unlock()
+
+	if full {
+		p.send(batch)
+	}
+	return future
+}
+
+// Flush a batch when its linger time is up, unless it was already flushed
+func (p *AsyncProducer) flushBatch(batch *topicBatch) {
+	p.mu.Lock()
+	if p.batches[batch.topic] != batch {
+		p.mu.Unlock()
+		return
+	}
+	delete(p.batches, batch.topic)
+	p.mu.Unlock()
+
+	p.send(batch)
+}
+
+// Send every batch right away and wait until the broker answered all of them,
+// including the batches sent before
+func (p *AsyncProducer) Flush() error {
+	p.mu.Lock()
+	batches := make([]*topicBatch, 0, len(p.batches))
+	for topic, batch := range p.batches {
+		batch.timer.Stop()
+		delete(p.batches, topic)
+		batches = append(batches, batch)
+	}
+	p.mu.Unlock()
+
+	for _, batch := range batches {
+		p.send(batch)
+	}
+
+	// Every batch sent so far is either answered or waiting in the session
+	p.sendMu.Lock()
+	if p.session != nil {
+		p.session.mu.Lock()
+		batches = append(batches, p.session.pending...)
+		p.session.mu.Unlock()
+	}
+	p.sendMu.Unlock()
+
+	var firstErr error
+	for _, batch := range batches {
+		for _, f := range batch.futures {
+			if _, err := f.Wait(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Flush the remaining messages and close the connection to the broker
+func (p *AsyncProducer) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+
+	err := p.Flush()
+
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+	if p.session != nil {
+		p.session.fail(ErrProducerClosed)
+		p.session = nil
+	}
+	return err
+}
+
+// Write a batch to the broker, a failure resolves every future of the batch
+func (p *AsyncProducer) send(batch *topicBatch) {
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+
+	session, err := p.openSession()
+	if err != nil {
+		batch.fail(err)
+		return
+	}
+
+	session.mu.Lock()
+	if session.broken {
+		err := session.err
+		session.mu.Unlock()
+		batch.fail(err)
+		return
+	}
+	session.pending = append(session.pending, batch)
+	session.mu.Unlock()
+
+	err = utils.WriteGobFrame(session.conn, utils.FramePublishBatch, &utils.PublishBatch{
+		Topic:    batch.topic,
+		Messages: batch.messages,
+	})
+	if err != nil {
+		p.Logger.Error("Error sending batch to broker: %s", err)
+		session.fail(err)
+	}
+}
+
+// Reuse the current session or dial a new one if there is none or it broke,
+// must be called with sendMu held
+func (p *AsyncProducer) openSession() (*asyncSession, error) {
+	if p.session != nil {
+		p.session.mu.Lock()
+		broken := p.session.broken
+		p.session.mu.Unlock()
+		if !broken {
+			return p.session, nil
+		}
+	}
+
+	err := p.ConnectBroker(p.brokerAdr)
+	if err != nil {
+		return nil, err
+	}
+	err = p.SendMessageToBroker(utils.FrameHandshake, &utils.ClientMessage{
+		Metadata: utils.Metadata{
+			Role:      "producer",
+			Token:     p.Token,
+			Namespace: p.Namespace,
+		},
+	})
+	if err != nil {
+		p.Conn.Close()
+		return nil, err
+	}
+
+	session := &asyncSession{conn: p.Conn}
+	p.session = session
+	go p.readAcks(session)
+	return session, nil
+}
+
+// Resolve the futures of every batch as the broker acks arrive
+func (p *AsyncProducer) readAcks(session *asyncSession) {
+	reader := bufio.NewReader(session.conn)
+	for {
+		frame, err := p.ReadBrokerFrame(reader)
+		var brokerErr *utils.ErrorMessage
+		if err != nil && !errors.As(err, &brokerErr) {
+			session.fail(err)
+			return
+		}
+
+		batch := session.popPending()
+		if batch == nil {
+			session.fail(fmt.Errorf("%w: ack without pending batch", utils.ErrUnexpectedFrame))
+			return
+		}
+		if brokerErr != nil {
+			batch.fail(brokerErr)
+			continue
+		}
+		if frame.Type != utils.FramePublishBatchAck {
+			batch.fail(fmt.Errorf("%w: %d", utils.ErrUnexpectedFrame, frame.Type))
+			session.fail(fmt.Errorf("%w: %d", utils.ErrUnexpectedFrame, frame.Type))
+			return
+		}
+
+		var batchAck utils.PublishBatchAck
+		if err := utils.DecodeGobFrame(frame, &batchAck); err != nil || len(batchAck.Acks) != len(batch.futures) {
+			if err == nil {
+				err = fmt.Errorf("broker acked %d messages, batch has %d", len(batchAck.Acks), len(batch.futures))
+			}
+			batch.fail(err)
+			continue
+		}
+		for i, f := range batch.futures {
+			ack := batchAck.Acks[i]
+			p.Clock.Update(ack.Physical, ack.Logical)
+			f.resolve(&ack, nil)
+		}
+	}
+}
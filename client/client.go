@@ -2,29 +2,106 @@ package client
 
 import (
 	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/MorElf7/GoMQ/utils"
 )
 
 type Client struct {
-	Conn   net.Conn
-	Logger *utils.LoggerType
+	Conn         net.Conn
+	Logger       *utils.LoggerType
+	MaxFrameSize uint32      // Max payload size accepted from the broker, default to utils.DefaultMaxFrameSize
+	TLSConfig    *tls.Config // Connect to the broker over TLS if set, see utils.ClientTLSConfig
+	Token        string      // Credentials sent at handshake, a token of the broker token file or a JWT
+	Namespace    string      // Namespace of the topics of the client, the default namespace if empty
 }
 
 type Consumer struct {
 	Client
-	run         bool
-	EachMessage func(msg string)
+	Subscription  string        // Durable subscription name, leave empty for a one off subscription
+	Group         string        // Consumer group to join, each message of the topic goes to one member of the group
+	Credit        utils.Credit  // Messages the broker may push ahead of the acks, one at a time if zero
+	FetchMaxBytes int           // Max content size of a Fetch, the broker picks a default if zero
+	FetchWait     time.Duration // How long Fetch waits for a message when none is available
+	EachMessage   func(msg string)
+	OnMessage     func(msg *utils.HLCMsg)       // Called instead of EachMessage if set, with the whole message
+	Handler       func(msg *utils.HLCMsg) error // Called instead of OnMessage if set, an error nacks the message and the broker sends it again later
+	run           bool
+	seekMu        sync.Mutex  // One seek at a time
+	seeking       atomic.Bool // Messages are dropped until the broker answers the seek
+	seekCh        chan seekResult
+	done          chan struct{} // Closed when the subscription ends
+	fetchMu       sync.Mutex    // One request at a time on a pull subscription, guard reader
+	reader        *bufio.Reader // Set while a pull subscription is open
+}
+
+var ErrNotSubscribed = errors.New("consumer is not subscribed")
+
+// Error for a Handler to return to have the message sent again after Delay,
+// instead of after the backoff of the broker
+type RequeueError struct {
+	Err   error
+	Delay time.Duration
+}
+
+func Requeue(err error, delay time.Duration) error {
+	return &RequeueError{Err: err, Delay: delay}
+}
+
+func (e *RequeueError) Error() string {
+	return fmt.Sprintf("requeue in %s: %s", e.Delay, e.Err)
+}
+
+func (e *RequeueError) Unwrap() error {
+	return e.Err
+}
+
+// Error for a Handler to return when the message must not be sent again, it
+// goes to the dead letter topic of the topic if there is one or is dropped
+type RejectError struct {
+	Err error
+}
+
+func Reject(err error) error {
+	return &RejectError{Err: err}
+}
+
+func (e *RejectError) Error() string {
+	return fmt.Sprintf("rejected: %s", e.Err)
+}
+
+func (e *RejectError) Unwrap() error {
+	return e.Err
+}
+
+type seekResult struct {
+	offset uint64
+	err    error
 }
 
 type Producer struct {
 	Client
-	Clock *utils.HLC
+	Clock     *utils.HLC
+	brokerAdr string        // Broker the current session is connected to
+	reader    *bufio.Reader // Reader for the acks of the current session
+	mu        sync.Mutex    // One publish at a time on the session
 }
 
+// Connect to the broker, over TLS if the client has a TLS config
 func (c *Client) ConnectBroker(brokerAdr string) error {
-	conn, err := net.Dial("tcp", brokerAdr)
+	var conn net.Conn
+	var err error
+	if c.TLSConfig != nil {
+		conn, err = tls.Dial("tcp", brokerAdr, c.TLSConfig)
+	} else {
+		conn, err = net.Dial("tcp", brokerAdr)
+	}
 	if err != nil {
 		c.Logger.Error("Error connected to broker: %s", err)
 		return err
@@ -33,65 +110,196 @@ func (c *Client) ConnectBroker(brokerAdr string) error {
 	return nil
 }
 
-func (c *Client) SendMessageToBroker(msg *utils.ClientMessage) error {
-	writer := bufio.NewWriter(c.Conn)
-	msgEncode, err := utils.MessageEncode(msg)
-	if err != nil {
-		c.Logger.Error(err.Error())
+func (c *Client) maxFrameSize() uint32 {
+	if c.MaxFrameSize == 0 {
+		return utils.DefaultMaxFrameSize
 	}
+	return c.MaxFrameSize
+}
 
-	_, err = writer.Write(msgEncode)
+func (c *Client) SendMessageToBroker(frameType utils.FrameType, msg *utils.ClientMessage) error {
+	err := utils.WriteMessageFrame(c.Conn, frameType, msg)
 	if err != nil {
+		c.Logger.Error(err.Error())
 		return err
 	}
-	writer.Flush()
-
-	// Add ack for message published ?
 
 	return nil
 }
 
+// Read the next frame from the broker, an error frame is returned as an error
+func (c *Client) ReadBrokerFrame(reader *bufio.Reader) (*utils.Frame, error) {
+	frame, err := utils.ReadFrame(reader, c.maxFrameSize())
+	if err != nil {
+		return nil, err
+	}
+	if frame.Type == utils.FrameError {
+		return nil, utils.DecodeErrorFrame(frame)
+	}
+	return frame, nil
+}
+
 func (c *Consumer) Subscribe(brokerAdr, topic string, replay bool) error {
+	return c.subscribe(brokerAdr, topic, replay, utils.StartPosition{})
+}
+
+// Subscribe starting from the given position, see utils.FromEarliest,
+// utils.FromLatest, utils.FromOffset and utils.FromTime. The position
+// overrides the stored position of a durable subscription or group. The
+// position of a group is only taken from the member starting it, it is ignored
+// for a member joining a group that already has members.
+func (c *Consumer) SubscribeFrom(brokerAdr, topic string, start utils.StartPosition) error {
+	return c.subscribe(brokerAdr, topic, false, start)
+}
+
+func (c *Consumer) subscribe(brokerAdr, topic string, replay bool, start utils.StartPosition) error {
 	// Prepare handshake
 	clientMessage := &utils.ClientMessage{
 		Metadata: utils.Metadata{
-			Role:   "consumer",
-			Topic:  topic,
-			Replay: replay,
+			Role:         "consumer",
+			Token:        c.Token,
+			Namespace:    c.Namespace,
+			Topic:        topic,
+			Replay:       replay,
+			Subscription: c.Subscription,
+			Group:        c.Group,
+			Start:        start,
+			Credit:       c.Credit,
+			MaxFrameSize: c.maxFrameSize(),
 		},
 	}
 
-	c.ConnectBroker(brokerAdr)
+	err := c.ConnectBroker(brokerAdr)
+	if err != nil {
+		return err
+	}
 	defer c.Conn.Close()
-	c.SendMessageToBroker(clientMessage)
+	err = c.SendMessageToBroker(utils.FrameHandshake, clientMessage)
+	if err != nil {
+		return err
+	}
 	brokerReader := bufio.NewReader(c.Conn)
-	brokerWriter := bufio.NewWriter(c.Conn)
-	buf := make([]byte, 1000000)
+	c.seekMu.Lock()
+	c.seekCh = make(chan seekResult, 1)
+	c.done = make(chan struct{})
+	done := c.done
+	c.seekMu.Unlock()
+	defer close(done)
 	c.run = true
 	for c.run {
-		// 1 Mb buffer
-		n, err := brokerReader.Read(buf)
+		frame, err := c.ReadBrokerFrame(brokerReader)
+		var brokerErr *utils.ErrorMessage
+		if err != nil && c.seeking.Load() && errors.As(err, &brokerErr) {
+			c.endSeek(0, brokerErr)
+			continue
+		}
 		if err != nil {
+			c.Logger.Error("Error reading broker frame: %s", err)
 			return err
 		}
-		msgDecode, err := utils.MessageDecode(buf[:n])
+		if frame.Type == utils.FrameSeekAck {
+			var ack utils.SeekAck
+			err := utils.DecodeGobFrame(frame, &ack)
+			c.endSeek(ack.Offset, err)
+			continue
+		}
+		if frame.Type != utils.FrameMessage {
+			c.Logger.Error("Unexpected frame type %d from broker", frame.Type)
+			continue
+		}
+		if c.seeking.Load() {
+			// Sent before the broker got the seek, the broker drops it too
+			continue
+		}
+		msgDecode, err := utils.MessageDecode(frame.Payload)
 		if err != nil {
 			c.Logger.Error("Error decoding broker message: %s", err)
 			continue
 		}
 
-		_, err = brokerWriter.WriteString("ACK\n")
+		// The message is acked only once handled, a consumer dying in the
+		// handler gets it again
+		msg := msgDecode.Payload
+		var handlerErr error
+		if c.Handler != nil {
+			handlerErr = c.Handler(msg)
+		} else if c.OnMessage != nil {
+			c.OnMessage(msg)
+		} else {
+			c.EachMessage(msg.Text())
+		}
+
+		if handlerErr != nil {
+			c.Logger.Error("Message offset %d failed on attempt %d: %s", msg.Offset, msg.Attempt, handlerErr)
+			nack := &utils.Nack{
+				Offset: msg.Offset,
+				Reason: handlerErr.Error(),
+			}
+			var requeue *RequeueError
+			var reject *RejectError
+			if errors.As(handlerErr, &requeue) {
+				nack.Delay = requeue.Delay
+			} else if errors.As(handlerErr, &reject) {
+				nack.Reject = true
+			}
+			err = utils.WriteGobFrame(c.Conn, utils.FrameNack, nack)
+		} else {
+			err = utils.WriteGobFrame(c.Conn, utils.FrameAck, &utils.Ack{Offset: msg.Offset})
+		}
 		if err != nil {
 			return err
 		}
-		brokerWriter.Flush()
-
-		c.EachMessage(msgDecode.Payload.Content)
 	}
 
 	return nil
 }
 
+// Change how many messages the broker may push ahead of the acks on the
+// running subscription
+func (c *Consumer) SetCredit(credit utils.Credit) error {
+	c.seekMu.Lock()
+	defer c.seekMu.Unlock()
+
+	if c.done == nil {
+		return ErrNotSubscribed
+	}
+	c.Credit = credit
+	return utils.WriteGobFrame(c.Conn, utils.FrameCredit, &credit)
+}
+
+// Move the running subscription to a new position and return the offset of
+// the next message. Messages still on the way from the old position are
+// dropped. Must not be called from EachMessage or OnMessage.
+func (c *Consumer) Seek(pos utils.StartPosition) (uint64, error) {
+	c.seekMu.Lock()
+	defer c.seekMu.Unlock()
+
+	if c.pulling() {
+		return c.seekPull(pos)
+	}
+	if c.done == nil {
+		return 0, ErrNotSubscribed
+	}
+	c.seeking.Store(true)
+	defer c.seeking.Store(false)
+	if err := utils.WriteGobFrame(c.Conn, utils.FrameSeek, &pos); err != nil {
+		return 0, err
+	}
+	select {
+	case result := <-c.seekCh:
+		return result.offset, result.err
+	case <-c.done:
+		return 0, ErrNotSubscribed
+	}
+}
+
+// Hand the broker answer over to the pending seek, if any
+func (c *Consumer) endSeek(offset uint64, err error) {
+	if c.seeking.CompareAndSwap(true, false) {
+		c.seekCh <- seekResult{offset: offset, err: err}
+	}
+}
+
 func (c *Consumer) Stop() {
 	c.run = false
 }
@@ -103,34 +311,181 @@ func NewConsumer() *Consumer {
 
 	return &Consumer{
 		Client: Client{
-			Logger: l,
+			Logger:       l,
+			MaxFrameSize: utils.DefaultMaxFrameSize,
 		},
 	}
 }
 
+// Publish a message and wait for the broker to store it
 func (p *Producer) Publish(brokerAdr, topic, message string) error {
-	// Prepare handshake
-	physical, logical := p.Clock.Now()
-	hlcMessage := &utils.HLCMsg{
-		Content:  message,
-		Physical: physical,
-		Logical:  logical,
-	}
+	_, err := p.PublishWithAck(brokerAdr, topic, message)
+	return err
+}
+
+// Publish a message and return the broker ack, which carries the ID and HLC
+// timestamp assigned by the broker. The connection to the broker is kept open
+// and reused by the next publish.
+func (p *Producer) PublishWithAck(brokerAdr, topic, message string) (*utils.PublishAck, error) {
+	return p.PublishMessage(brokerAdr, topic, &utils.HLCMsg{Body: []byte(message)})
+}
+
+// Publish a binary body with its content type and headers, either may be empty
+func (p *Producer) PublishBytes(brokerAdr, topic string, body []byte, contentType string, headers map[string]string) (*utils.PublishAck, error) {
+	return p.PublishMessage(brokerAdr, topic, &utils.HLCMsg{
+		Body:        body,
+		ContentType: contentType,
+		Headers:     headers,
+	})
+}
+
+// Publish a message delivered to the consumers at the given time, the broker
+// stores it right away
+func (p *Producer) PublishAt(brokerAdr, topic, message string, at time.Time) (*utils.PublishAck, error) {
+	return p.PublishMessage(brokerAdr, topic, &utils.HLCMsg{
+		Body:      []byte(message),
+		DeliverAt: at.UnixNano(),
+	})
+}
+
+// Publish a message delivered to the consumers once the delay has passed on
+// the broker clock
+func (p *Producer) PublishDelayed(brokerAdr, topic, message string, delay time.Duration) (*utils.PublishAck, error) {
+	return p.PublishMessage(brokerAdr, topic, &utils.HLCMsg{
+		Body:  []byte(message),
+		Delay: delay,
+	})
+}
+
+// Publish a message expiring after ttl, it is not delivered any more once
+// expired
+func (p *Producer) PublishWithTTL(brokerAdr, topic, message string, ttl time.Duration) (*utils.PublishAck, error) {
+	return p.PublishMessage(brokerAdr, topic, &utils.HLCMsg{
+		Body: []byte(message),
+		TTL:  ttl,
+	})
+}
+
+// Publish a message under a key, a compacted topic only keeps the newest
+// message of each key
+func (p *Producer) PublishWithKey(brokerAdr, topic, key, message string) (*utils.PublishAck, error) {
+	return p.PublishMessage(brokerAdr, topic, &utils.HLCMsg{
+		Body: []byte(message),
+		Key:  key,
+	})
+}
+
+// Publish a tombstone deleting the key from a compacted topic
+func (p *Producer) PublishTombstone(brokerAdr, topic, key string) (*utils.PublishAck, error) {
+	return p.PublishMessage(brokerAdr, topic, &utils.HLCMsg{
+		Key:       key,
+		Tombstone: true,
+	})
+}
+
+// Publish a message with any of its delivery options set, the producer sets
+// its timestamp
+func (p *Producer) PublishMessage(brokerAdr, topic string, hlcMessage *utils.HLCMsg) (*utils.PublishAck, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	hlcMessage.Physical, hlcMessage.Logical = p.Clock.Now()
 
 	clientMessage := &utils.ClientMessage{
 		Payload: hlcMessage,
 		Metadata: utils.Metadata{
-			Role:  "producer",
 			Topic: topic,
 		},
 	}
 
+	var ack utils.PublishAck
+	err := p.roundTrip(brokerAdr, utils.FramePublish, clientMessage, utils.FramePublishAck, &ack)
+	if err != nil {
+		return nil, err
+	}
+	p.Clock.Update(ack.Physical, ack.Logical)
+	return &ack, nil
+}
+
+// Send a request on the session and decode the broker answer into response.
+// An error frame is returned as a *utils.ErrorMessage and keeps the session
+// open, any other failure closes it so the next request dials again. Must be
+// called with mu held.
+func (p *Producer) roundTrip(brokerAdr string, frameType utils.FrameType, request any, expect utils.FrameType, response any) error {
+	err := p.openSession(brokerAdr)
+	if err != nil {
+		return err
+	}
+	err = utils.WriteGobFrame(p.Conn, frameType, request)
+	if err != nil {
+		p.Logger.Error(err.Error())
+		p.closeSession()
+		return err
+	}
+
+	frame, err := p.ReadBrokerFrame(p.reader)
+	if err != nil {
+		if _, ok := err.(*utils.ErrorMessage); !ok {
+			p.closeSession()
+		}
+		return err
+	}
+	if frame.Type != expect {
+		p.closeSession()
+		return fmt.Errorf("%w: %d", utils.ErrUnexpectedFrame, frame.Type)
+	}
+
+	if err := utils.DecodeGobFrame(frame, response); err != nil {
+		p.closeSession()
+		return err
+	}
+	return nil
+}
+
+// Dial the broker and send the producer handshake, unless a session to this
+// broker is already open
+func (p *Producer) openSession(brokerAdr string) error {
+	if p.Conn != nil && p.brokerAdr == brokerAdr {
+		return nil
+	}
+	p.closeSession()
+
 	err := p.ConnectBroker(brokerAdr)
 	if err != nil {
 		return err
 	}
-	defer p.Conn.Close()
-	return p.SendMessageToBroker(clientMessage)
+	err = p.SendMessageToBroker(utils.FrameHandshake, &utils.ClientMessage{
+		Metadata: utils.Metadata{
+			Role:      "producer",
+			Token:     p.Token,
+			Namespace: p.Namespace,
+		},
+	})
+	if err != nil {
+		p.Conn.Close()
+		p.Conn = nil
+		return err
+	}
+	p.brokerAdr = brokerAdr
+	p.reader = bufio.NewReader(p.Conn)
+	return nil
+}
+
+func (p *Producer) closeSession() {
+	if p.Conn != nil {
+		p.Conn.Close()
+	}
+	p.Conn = nil
+	p.reader = nil
+	p.brokerAdr = ""
+}
+
+// Close the connection to the broker
+func (p *Producer) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closeSession()
 }
 
 func NewProducer() *Producer {
@@ -141,7 +496,8 @@ func NewProducer() *Producer {
 	return &Producer{
 		Clock: utils.NewHLC(),
 		Client: Client{
-			Logger: l,
+			Logger:       l,
+			MaxFrameSize: utils.DefaultMaxFrameSize,
 		},
 	}
 }
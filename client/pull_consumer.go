@@ -0,0 +1,153 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/MorElf7/GoMQ/utils"
+)
+
+// Time left to the broker to answer a long poll before the Fetch deadline
+const fetchDeadlineMargin = 100 * time.Millisecond
+
+// Open a pull subscription to a topic. Nothing is pushed to EachMessage or
+// OnMessage, messages are read with Fetch at the pace of the consumer.
+// Subscription and Group apply as for Subscribe.
+func (c *Consumer) SubscribePull(brokerAdr, topic string, start utils.StartPosition) error {
+	c.fetchMu.Lock()
+	defer c.fetchMu.Unlock()
+
+	if c.reader != nil {
+		return fmt.Errorf("consumer already has a pull subscription")
+	}
+	err := c.ConnectBroker(brokerAdr)
+	if err != nil {
+		return err
+	}
+	err = c.SendMessageToBroker(utils.FrameHandshake, &utils.ClientMessage{
+		Metadata: utils.Metadata{
+			Role:         "consumer",
+			Token:        c.Token,
+			Namespace:    c.Namespace,
+			Topic:        topic,
+			Subscription: c.Subscription,
+			Group:        c.Group,
+			Start:        start,
+			Pull:         true,
+		},
+	})
+	if err != nil {
+		c.Conn.Close()
+		return err
+	}
+	c.reader = bufio.NewReader(c.Conn)
+	return nil
+}
+
+// Fetch up to max messages from the position of the pull subscription, and
+// at most FetchMaxBytes of content unless a single message is bigger. A
+// message that does not fit in a frame of MaxFrameSize fails the Fetch with a
+// frame_too_large broker error, Seek moves the subscription past it. If no
+// message is available the broker waits up to FetchWait for one, an empty
+// slice is returned when none arrived. Fetching acknowledges the messages of
+// the previous Fetch. The subscription is closed if ctx is done before the
+// broker answers.
+func (c *Consumer) Fetch(ctx context.Context, max int) ([]*utils.HLCMsg, error) {
+	c.fetchMu.Lock()
+	defer c.fetchMu.Unlock()
+
+	if c.reader == nil {
+		return nil, ErrNotSubscribed
+	}
+	wait := c.FetchWait
+	if deadline, ok := ctx.Deadline(); ok {
+		// Have the broker answer before the deadline instead of losing the
+		// subscription to it
+		wait = min(wait, time.Until(deadline)-fetchDeadlineMargin)
+	}
+	req := &utils.FetchRequest{
+		Max:          max,
+		MaxBytes:     c.FetchMaxBytes,
+		Wait:         wait,
+		MaxFrameSize: c.maxFrameSize(),
+	}
+
+	var resp utils.FetchResponse
+	if err := c.pullRoundTrip(ctx, utils.FrameFetch, req, utils.FrameFetchResponse, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Messages, nil
+}
+
+// Close the pull subscription, the messages of the last Fetch are not
+// acknowledged and a durable subscription or group gets them again
+func (c *Consumer) Close() error {
+	c.fetchMu.Lock()
+	defer c.fetchMu.Unlock()
+
+	return c.closePull()
+}
+
+func (c *Consumer) pulling() bool {
+	c.fetchMu.Lock()
+	defer c.fetchMu.Unlock()
+
+	return c.reader != nil
+}
+
+func (c *Consumer) seekPull(pos utils.StartPosition) (uint64, error) {
+	c.fetchMu.Lock()
+	defer c.fetchMu.Unlock()
+
+	if c.reader == nil {
+		return 0, ErrNotSubscribed
+	}
+	var ack utils.SeekAck
+	if err := c.pullRoundTrip(context.Background(), utils.FrameSeek, &pos, utils.FrameSeekAck, &ack); err != nil {
+		return 0, err
+	}
+	return ack.Offset, nil
+}
+
+// Send a request on the pull subscription and decode the answer, must be
+// called with fetchMu held. A broken exchange closes the subscription since
+// the answers would no longer match the requests.
+func (c *Consumer) pullRoundTrip(ctx context.Context, frameType utils.FrameType, request any, expect utils.FrameType, response any) error {
+	stop := context.AfterFunc(ctx, func() {
+		c.Conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	err := utils.WriteGobFrame(c.Conn, frameType, request)
+	if err != nil {
+		c.closePull()
+		return err
+	}
+	frame, err := c.ReadBrokerFrame(c.reader)
+	if err == nil && frame.Type != expect {
+		err = fmt.Errorf("%w: %d", utils.ErrUnexpectedFrame, frame.Type)
+	}
+	if err == nil {
+		err = utils.DecodeGobFrame(frame, response)
+	}
+	if ctx.Err() != nil {
+		c.closePull()
+		return ctx.Err()
+	}
+	var brokerErr *utils.ErrorMessage
+	if err != nil && !errors.As(err, &brokerErr) {
+		c.closePull()
+	}
+	return err
+}
+
+func (c *Consumer) closePull() error {
+	if c.reader == nil {
+		return nil
+	}
+	c.reader = nil
+	return c.Conn.Close()
+}
@@ -2,8 +2,9 @@ module producer
 
 go 1.21.1
 
+require github.com/MorElf7/GoMQ/client v0.0.0-20240930032856-9cb0d6d5ba17
+
 require (
-	github.com/MorElf7/GoMQ/client v0.0.0-20240930032856-9cb0d6d5ba17 // indirect
 	github.com/MorElf7/GoMQ/utils v0.0.0-20240930032513-f061cdca4531 // indirect
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/dgraph-io/badger/v4 v4.3.0 // indirect
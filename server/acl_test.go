@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/MorElf7/GoMQ/utils"
+)
+
+// Broker where mallory may only publish to and administer the topic dlq
+func startACLBroker(t *testing.T) (*Broker, string) {
+	t.Helper()
+	b, addr := startTestBroker(t, nil)
+	dir := t.TempDir()
+	tokens := filepath.Join(dir, "tokens.txt")
+	acl := filepath.Join(dir, "acl.txt")
+	if err := os.WriteFile(tokens, []byte("mallory m4llory\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(acl, []byte("mallory publish,admin dlq\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := utils.LoadTokenFile(tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.auth = auth
+	if b.acl, err = utils.LoadACLFile(acl); err != nil {
+		t.Fatal(err)
+	}
+	return b, addr
+}
+
+func isForbidden(err error) bool {
+	var brokerErr *utils.ErrorMessage
+	return errors.As(err, &brokerErr) && brokerErr.Code == utils.ErrCodeForbidden
+}
+
+func TestRedriveNeedsPublishOnTargets(t *testing.T) {
+	b, addr := startACLBroker(t)
+	p := newTestProducer(nil)
+	p.Token = "m4llory"
+
+	// A dead letter pointing at a topic mallory may not publish to
+	_, err := p.PublishBytes(addr, "dlq", []byte("forged"), "", map[string]string{utils.HeaderOriginalTopic: "billing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Redrive(addr, "dlq"); !isForbidden(err) {
+		t.Fatalf("re-drive into billing: got %v, want forbidden", err)
+	}
+	if _, exists := b.topicManager.GetPool("billing"); exists {
+		t.Fatal("re-drive created topic billing")
+	}
+}
+
+func TestDeadLetterTopicNeedsPublish(t *testing.T) {
+	_, addr := startACLBroker(t)
+	p := newTestProducer(nil)
+	p.Token = "m4llory"
+
+	err := p.SetTopicConfig(addr, "dlq", utils.TopicConfig{MaxDeliveryAttempts: 1, DeadLetterTopic: "billing"})
+	if !isForbidden(err) {
+		t.Fatalf("dead letter topic billing: got %v, want forbidden", err)
+	}
+	// Dead letters of dlq default to dlq.DLQ, not granted either
+	err = p.SetTopicConfig(addr, "dlq", utils.TopicConfig{MaxDeliveryAttempts: 1})
+	if !isForbidden(err) {
+		t.Fatalf("default dead letter topic: got %v, want forbidden", err)
+	}
+	if err := p.SetTopicConfig(addr, "dlq", utils.TopicConfig{DefaultTTL: 0}); err != nil {
+		t.Fatalf("config without dead lettering: %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	GoMQ "github.com/MorElf7/GoMQ/client"
+	"github.com/MorElf7/GoMQ/utils"
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+func discardLogger() *utils.LoggerType {
+	return &utils.LoggerType{
+		InfoLogger:  log.New(io.Discard, "", 0),
+		ErrorLogger: log.New(io.Discard, "", 0),
+	}
+}
+
+// Broker with an in-memory store serving on a local port, over TLS if
+// tlsConfig is set. Return the broker and its address.
+func startTestBroker(t testing.TB, tlsConfig *tls.Config) (*Broker, string) {
+	t.Helper()
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	logger := discardLogger()
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &Broker{
+		ctx:          ctx,
+		db:           db,
+		topicManager: utils.NewTopicManager(logger),
+		logger:       logger,
+		maxFrameSize: utils.DefaultMaxFrameSize,
+		quotas:       &utils.PublishQuotas{},
+		connections:  &connectionCounter{clients: make(map[string]int)},
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.handleConnection(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		listener.Close()
+		<-done
+		// Let the connection handlers see the broker is shutting down
+		time.Sleep(50 * time.Millisecond)
+		db.Close()
+	})
+	return b, listener.Addr().String()
+}
+
+func newTestProducer(tlsConfig *tls.Config) *GoMQ.Producer {
+	p := GoMQ.NewProducer()
+	p.Logger = discardLogger()
+	p.TLSConfig = tlsConfig
+	return p
+}
+
+func newTestConsumer(tlsConfig *tls.Config) *GoMQ.Consumer {
+	c := GoMQ.NewConsumer()
+	c.Logger = discardLogger()
+	c.TLSConfig = tlsConfig
+	return c
+}
+
+// Replay a topic from the start and return the first n messages
+func consumeN(t testing.TB, c *GoMQ.Consumer, addr, topic string, n int) []*utils.HLCMsg {
+	t.Helper()
+	var messages []*utils.HLCMsg
+	received := make(chan struct{})
+	c.OnMessage = func(msg *utils.HLCMsg) {
+		messages = append(messages, msg)
+		if len(messages) == n {
+			close(received)
+		}
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- c.Subscribe(addr, topic, true) }()
+	select {
+	case <-received:
+		c.Conn.Close()
+		<-errc
+		return messages
+	case err := <-errc:
+		t.Fatalf("subscription to %s ended after %d of %d messages: %v", topic, len(messages), n, err)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("received %d of %d messages of %s", len(messages), n, topic)
+	}
+	return nil
+}
+
+// Wait until a topic has n subscriptions
+func waitSubscriptions(t testing.TB, b *Broker, topic string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if pool, exists := b.topicManager.GetPool(topic); exists {
+			pool.Mutex.RLock()
+			connected := len(pool.Connections)
+			pool.Mutex.RUnlock()
+			if connected >= n {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("topic %s did not reach %d subscriptions", topic, n)
+}
+
+// A frame over the max frame size is reported and ends the session, the
+// broker does not read its payload
+func TestOversizeFrameClosesConnection(t *testing.T) {
+	_, addr := startTestBroker(t, nil)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	err = utils.WriteMessageFrame(conn, utils.FrameHandshake, &utils.ClientMessage{Metadata: utils.Metadata{Role: "producer"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the header, announcing a payload over the max frame size
+	header := binary.BigEndian.AppendUint32(nil, utils.DefaultMaxFrameSize+1)
+	if _, err := conn.Write(append(header, utils.FrameVersion, byte(utils.FramePublish))); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	frame, err := utils.ReadFrame(reader, utils.DefaultMaxFrameSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Type != utils.FrameError || utils.DecodeErrorFrame(frame).Code != utils.ErrCodeFrameTooLarge {
+		t.Fatalf("got frame of type %d, want a frame too large error", frame.Type)
+	}
+	if _, err := utils.ReadFrame(reader, utils.DefaultMaxFrameSize); err != io.EOF {
+		t.Fatalf("connection still open after an oversize frame, read returned %v", err)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/MorElf7/GoMQ/utils"
+)
+
+const (
+	ackTimeout      = 2 * time.Second        // Time a consumer has to ack a message before it is sent again
+	retryBackoff    = 500 * time.Millisecond // Wait before sending a failed message again, doubled on each attempt
+	maxRetryBackoff = 30 * time.Second
+)
+
+// Wait before sending again a message failed on the given attempt
+func backoff(attempt int) time.Duration {
+	d := retryBackoff
+	for i := 1; i < attempt && d < maxRetryBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxRetryBackoff)
+}
+
+// Message pushed to a consumer and waiting for its ack, or failed and waiting
+// to be sent again
+type delivery struct {
+	msg      *utils.HLCMsg
+	attempt  int
+	deadline time.Time // Ack deadline while in flight, end of the backoff once failed
+}
+
+// Messages of a push subscription
+type window struct {
+	credit     utils.Credit
+	deliveries []*delivery // In flight, in the order they were sent
+	failed     []*delivery // Nacked or timed out, they go back to the pending messages after their backoff
+	bytes      int
+}
+
+// Room left for a message of the given size
+func (w *window) fits(size int) bool {
+	if len(w.deliveries) == 0 {
+		return true
+	}
+	if len(w.deliveries) >= max(w.credit.Messages, 1) {
+		return false
+	}
+	return w.credit.Bytes <= 0 || w.bytes+size <= w.credit.Bytes
+}
+
+func (w *window) full() bool {
+	return !w.fits(0)
+}
+
+// Remove the delivery of the message at offset, or the oldest one if offset is
+// nil
+func (w *window) remove(offset *uint64) *delivery {
+	for i, d := range w.deliveries {
+		if offset == nil || d.msg.Offset == *offset {
+			w.deliveries = append(w.deliveries[:i], w.deliveries[i+1:]...)
+			w.bytes -= len(d.msg.Body)
+			return d
+		}
+	}
+	return nil
+}
+
+// Move a delivery out of the window until its backoff is over
+func (w *window) fail(d *delivery, delay time.Duration) {
+	d.deadline = time.Now().Add(delay)
+	w.failed = append(w.failed, d)
+}
+
+// Earliest deadline of the messages in flight or failed
+func (w *window) nextDeadline() (time.Time, bool) {
+	var next time.Time
+	for _, list := range [][]*delivery{w.deliveries, w.failed} {
+		for _, d := range list {
+			if next.IsZero() || d.deadline.Before(next) {
+				next = d.deadline
+			}
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// Push the messages of a topic to a consumer, keeping as many of them in flight
+// as the consumer credit allows. Acks can come in any order. A message nacked
+// or without ack in time is sent again after a backoff, to the same consumer
+// or to another member of its group. A message too large for the frames of
+// the consumer ends the subscription, it is left for the other members.
+func (b *Broker) servePush(ctx context.Context, conn net.Conn, topic, connectionId, id string, frames <-chan *utils.Frame, credit utils.Credit, frameSize uint32) {
+	logger := b.logger
+	topicManager := b.topicManager
+	_, consumer, _ := topicManager.GetConnection(topic, connectionId)
+	pendingMessage := consumer.PendingMessage
+	if frameSize == 0 {
+		frameSize = utils.DefaultMaxFrameSize
+	}
+
+	w := &window{credit: credit}
+	defer func() {
+		// Hand the messages over to another member of the group
+		for _, d := range append(w.deliveries, w.failed...) {
+			topicManager.Release(topic, connectionId, d.msg)
+		}
+	}()
+
+	for {
+		// Fill the window. A message too large for the byte credit left stays
+		// at the head of the pending messages until an ack makes room for it.
+		blocked := false
+		for !w.full() {
+			now := time.Now()
+			msg, refused := pendingMessage.GetNextMessageIf(func(msg *utils.HLCMsg) bool {
+				return msg.Expired(now) || w.fits(len(msg.Body))
+			})
+			if refused {
+				blocked = true
+				break
+			}
+			if msg == nil {
+				// Read the next messages from the topic log if the consumer is behind
+				n, err := topicManager.FillPending(b.db, topic, connectionId)
+				if err != nil {
+					logger.Error("Error reading topic %s: %s", topic, err)
+				}
+				if n > 0 {
+					continue
+				}
+				break
+			}
+			if msg.Expired(now) {
+				if err := topicManager.DropExpired(b.db, logger, topic, connectionId, msg); err != nil {
+					logger.Error("Error committing offset of consumer %s: %s", id, err)
+				}
+				continue
+			}
+			// Measured before the attempt is known, the largest takes the most bytes
+			if encoded, err := encodePush(topic, msg, math.MaxInt); err == nil && len(encoded) > int(frameSize) {
+				logger.Error("Message offset %d of topic %s takes %d bytes, consumer %s reads frames of up to %d", msg.Offset, topic, len(encoded), id, frameSize)
+				pendingMessage.AddMessage(msg)
+				utils.WriteErrorFrame(conn, utils.ErrCodeFrameTooLarge, "%s: message at offset %d takes %d bytes, the consumer reads frames of up to %d", utils.ErrFrameTooLarge, msg.Offset, len(encoded), frameSize)
+				return
+			}
+
+			d := &delivery{
+				msg:     msg,
+				attempt: topicManager.Delivered(topic, connectionId, msg),
+			}
+			// Out of attempts on the consumers connected before this one
+			if d.attempt > 1 && b.deadLetter(topic, connectionId, &delivery{msg: msg, attempt: d.attempt - 1}, "no ack from the consumer", false) {
+				continue
+			}
+			w.deliveries = append(w.deliveries, d)
+			w.bytes += len(msg.Body)
+			if !b.send(conn, topic, id, d) {
+				return
+			}
+		}
+
+		// Sleep until a message is published to the topic, the consumer sends
+		// a frame or an ack is late. A blocked window only opens on an ack or
+		// a credit change.
+		var ready <-chan struct{}
+		if !w.full() && !blocked {
+			ready = pendingMessage.Ready()
+		}
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if next, ok := w.nextDeadline(); ok {
+			timer = time.NewTimer(time.Until(next))
+			timeout = timer.C
+		}
+
+		select {
+		case <-ready:
+		case frame := <-frames:
+			b.handlePushFrame(conn, topic, connectionId, id, w, frame)
+		case <-timeout:
+			now := time.Now()
+			for _, d := range slices.Clone(w.deliveries) {
+				if d.deadline.After(now) {
+					continue
+				}
+				logger.Error("Timeout! No acknowledgment received for message ID: %v\n", d.msg.ID)
+				w.remove(&d.msg.Offset)
+				if b.deadLetter(topic, connectionId, d, "no ack from the consumer", false) {
+					continue
+				}
+				if config, _ := topicManager.TopicConfig(topic); d.attempt >= config.DeliveryAttempts() {
+					// Reach Max Limit of failed attemps then close connection
+					logger.Info("Reach max attemp sending message to consumer id %s", id)
+					w.fail(d, 0)
+					return
+				}
+				w.fail(d, backoff(d.attempt))
+			}
+			failed := w.failed[:0]
+			for _, d := range w.failed {
+				if d.deadline.After(now) {
+					failed = append(failed, d)
+					continue
+				}
+				topicManager.Release(topic, connectionId, d.msg)
+			}
+			w.failed = failed
+		case <-ctx.Done():
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Handle a frame of a push consumer: an ack, a credit change or a seek
+func (b *Broker) handlePushFrame(conn net.Conn, topic, connectionId, id string, w *window, frame *utils.Frame) {
+	logger := b.logger
+	topicManager := b.topicManager
+	switch frame.Type {
+	case utils.FrameAck:
+		var offset *uint64
+		if len(frame.Payload) > 0 {
+			var ack utils.Ack
+			if err := utils.DecodeGobFrame(frame, &ack); err != nil {
+				logger.Error("Invalid ack from consumer %s: %s", id, err)
+				return
+			}
+			offset = &ack.Offset
+		}
+		d := w.remove(offset)
+		if d == nil {
+			// Ack of a message sent again and already acked, or dropped by a seek
+			return
+		}
+		logger.Info("Acknowledgment received for message ID: %v offset %d, consumer %s is %d messages behind\n", d.msg.ID, d.msg.Offset, id, topicManager.Lag(topic, d.msg.Offset))
+		if err := topicManager.Acknowledge(b.db, topic, connectionId, d.msg.Offset); err != nil {
+			logger.Error("Error committing offset of consumer %s: %s", id, err)
+		}
+	case utils.FrameNack:
+		var nack utils.Nack
+		if err := utils.DecodeGobFrame(frame, &nack); err != nil {
+			logger.Error("Invalid nack from consumer %s: %s", id, err)
+			return
+		}
+		d := w.remove(&nack.Offset)
+		if d == nil {
+			return
+		}
+		reason := nack.Reason
+		if reason == "" {
+			reason = "rejected by the consumer"
+		}
+		if b.deadLetter(topic, connectionId, d, reason, nack.Reject) {
+			return
+		}
+		if nack.Reject {
+			// No dead letter topic, the message is dropped
+			logger.Info("Message ID: %v offset %d rejected by consumer %s, dropping it: %s", d.msg.ID, d.msg.Offset, id, reason)
+			if err := topicManager.Acknowledge(b.db, topic, connectionId, d.msg.Offset); err != nil {
+				logger.Error("Error committing offset of consumer %s: %s", id, err)
+			}
+			return
+		}
+		delay := nack.Delay
+		if delay <= 0 {
+			delay = backoff(d.attempt)
+		}
+		logger.Info("Message ID: %v offset %d rejected by consumer %s on attempt %d, sending it again in %s", d.msg.ID, d.msg.Offset, id, d.attempt, delay)
+		w.fail(d, delay)
+	case utils.FrameCredit:
+		var credit utils.Credit
+		if err := utils.DecodeGobFrame(frame, &credit); err != nil {
+			utils.WriteErrorFrame(conn, utils.ErrCodeBadRequest, "invalid credit: %s", err)
+			return
+		}
+		w.credit = credit
+	case utils.FrameSeek:
+		// The messages in flight belong to the old position, drop them
+		w.deliveries = nil
+		w.failed = nil
+		w.bytes = 0
+		b.handleSeek(conn, topic, connectionId, frame)
+	default:
+		logger.Error("Unexpected frame type %d from consumer %s", frame.Type, id)
+	}
+}
+
+// Move a failed message to the dead letter topic if its topic has one and the
+// message is out of attempts, or was rejected. Return false if the message
+// should be sent again.
+func (b *Broker) deadLetter(topic, connectionId string, d *delivery, reason string, rejected bool) bool {
+	config, err := b.topicManager.TopicConfig(topic)
+	if err != nil || config.MaxDeliveryAttempts <= 0 {
+		return false
+	}
+	if !rejected && d.attempt < config.MaxDeliveryAttempts {
+		return false
+	}
+	err = b.topicManager.DeadLetter(b.db, b.logger, topic, connectionId, d.msg, d.attempt, reason)
+	if err != nil {
+		b.logger.Error("Error moving message offset %d of topic %s to its dead letter topic: %s", d.msg.Offset, topic, err)
+		return false
+	}
+	return true
+}
+
+// Write a message in flight to the consumer and start waiting for its ack,
+// false if the connection is broken
+func (b *Broker) send(conn net.Conn, topic, id string, d *delivery) bool {
+	d.deadline = time.Now().Add(ackTimeout)
+	msgEncode, err := encodePush(topic, d.msg, d.attempt)
+	if err != nil {
+		b.logger.Error("Error encoding message: %s", err)
+		return true
+	}
+	b.logger.Info("Attemp %d sending message to consumer id %s", d.attempt, id)
+	if err := utils.WriteFrame(conn, utils.FrameMessage, msgEncode); err != nil {
+		utils.HandleNetworkErrorByPeer(b.logger, err)
+		return false
+	}
+	return true
+}
+
+// Encode a message as pushed to a consumer on the given attempt
+func encodePush(topic string, message *utils.HLCMsg, attempt int) ([]byte, error) {
+	msg := *message
+	msg.Attempt = attempt
+	// Clients know topics by their name within their namespace
+	_, msg.Topic = utils.SplitTopic(topic)
+	return utils.MessageEncode(&utils.ClientMessage{
+		Payload: &msg,
+		Metadata: utils.Metadata{
+			Topic: msg.Topic,
+		},
+	})
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	GoMQ "github.com/MorElf7/GoMQ/client"
+	"github.com/MorElf7/GoMQ/utils"
+)
+
+// Wait until the consumers of a topic are all gone
+func waitNoSubscriptions(t *testing.T, b *Broker, topic string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		pool, exists := b.topicManager.GetPool(topic)
+		if !exists {
+			return
+		}
+		pool.Mutex.RLock()
+		connected := len(pool.Connections)
+		pool.Mutex.RUnlock()
+		if connected == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("consumers of topic %s are still connected", topic)
+}
+
+// Wait until a durable subscription is stored at offset
+func waitSubscriptionOffset(t *testing.T, p *GoMQ.Producer, addr, topic, name string, offset uint64) utils.SubscriptionInfo {
+	t.Helper()
+	var subs []utils.SubscriptionInfo
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var err error
+		subs, err = p.ListSubscriptions(addr, topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, sub := range subs {
+			if sub.Name == name && sub.NextOffset == offset {
+				return sub
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("subscriptions %+v, want %s at offset %d", subs, name, offset)
+	return utils.SubscriptionInfo{}
+}
+
+// Receive n messages under a durable subscription, and disconnect once their
+// acks moved the subscription to offset
+func consumeAcked(t *testing.T, b *Broker, p *GoMQ.Producer, addr, topic, name string, n int, offset uint64) []*utils.HLCMsg {
+	t.Helper()
+	received := make(chan *utils.HLCMsg, n)
+	c := newTestConsumer(nil)
+	c.Subscription = name
+	c.OnMessage = func(msg *utils.HLCMsg) { received <- msg }
+	errc := make(chan error, 1)
+	go func() { errc <- c.Subscribe(addr, topic, true) }()
+
+	var messages []*utils.HLCMsg
+	for len(messages) < n {
+		select {
+		case msg := <-received:
+			messages = append(messages, msg)
+		case err := <-errc:
+			t.Fatalf("subscription %s ended after %d of %d messages: %v", name, len(messages), n, err)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("received %d of %d messages of %s", len(messages), n, topic)
+		}
+	}
+	waitSubscriptionOffset(t, p, addr, topic, name, offset)
+	c.Conn.Close()
+	<-errc
+	waitNoSubscriptions(t, b, topic)
+	return messages
+}
+
+// Receive the next message of a durable subscription and drop the connection
+// before acking it
+func receiveWithoutAck(t *testing.T, b *Broker, addr, topic, subscription string) *utils.HLCMsg {
+	t.Helper()
+	received := make(chan *utils.HLCMsg, 1)
+	c := newTestConsumer(nil)
+	c.Subscription = subscription
+	c.Handler = func(msg *utils.HLCMsg) error {
+		received <- msg
+		c.Conn.Close()
+		return nil
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- c.Subscribe(addr, topic, true) }()
+
+	var msg *utils.HLCMsg
+	select {
+	case msg = <-received:
+	case err := <-errc:
+		t.Fatalf("subscription %s ended without a message: %v", subscription, err)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("no message received by subscription %s", subscription)
+	}
+	<-errc
+	waitNoSubscriptions(t, b, topic)
+	return msg
+}
+
+// The delivery attempt of a message counts the sends to the consumers
+// connected before under the same durable subscription
+func TestAttemptsAddUpAcrossReconnects(t *testing.T) {
+	b, addr := startTestBroker(t, nil)
+	if err := newTestProducer(nil).Publish(addr, "attempts", "flaky"); err != nil {
+		t.Fatal(err)
+	}
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		msg := receiveWithoutAck(t, b, addr, "attempts", "worker")
+		if msg.Offset != 0 || msg.Attempt != attempt {
+			t.Fatalf("got offset %d attempt %d, want offset 0 attempt %d", msg.Offset, msg.Attempt, attempt)
+		}
+	}
+}
+
+// A message whose consumers all dropped the connection before acking it goes
+// to the dead letter topic once out of attempts
+func TestDeadLetterAfterReconnects(t *testing.T) {
+	b, addr := startTestBroker(t, nil)
+	p := newTestProducer(nil)
+	if err := p.SetTopicConfig(addr, "jobs", utils.TopicConfig{MaxDeliveryAttempts: 2}); err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"poison", "fine"} {
+		if err := p.Publish(addr, "jobs", body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for attempt := 1; attempt <= 2; attempt++ {
+		receiveWithoutAck(t, b, addr, "jobs", "worker")
+	}
+
+	// The next consumer gets the message after it
+	c := newTestConsumer(nil)
+	c.Subscription = "worker"
+	received := make(chan *utils.HLCMsg, 2)
+	c.OnMessage = func(msg *utils.HLCMsg) { received <- msg }
+	go c.Subscribe(addr, "jobs", true)
+	select {
+	case msg := <-received:
+		if msg.Text() != "fine" {
+			t.Fatalf("got %q after the message out of attempts, want fine", msg.Text())
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no message received after the message out of attempts")
+	}
+	c.Conn.Close()
+
+	dead := consumeN(t, newTestConsumer(nil), addr, "jobs.DLQ", 1)[0]
+	if dead.Text() != "poison" || dead.Headers[utils.HeaderAttempts] != "2" {
+		t.Fatalf("dead letter %q after %s attempts, want poison after 2", dead.Text(), dead.Headers[utils.HeaderAttempts])
+	}
+}
+
+// A message scheduled for later does not hold back the position of a durable
+// subscription, a consumer connecting again gets it once due and nothing twice
+func TestDelayedMessageDoesNotPinSubscription(t *testing.T) {
+	b, addr := startTestBroker(t, nil)
+	p := newTestProducer(nil)
+	if _, err := p.PublishMessage(addr, "later", &utils.HLCMsg{Body: []byte("delayed"), Delay: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		if err := p.Publish(addr, "later", fmt.Sprintf("now-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, msg := range consumeAcked(t, b, p, addr, "later", "worker", 5, 6) {
+		if msg.Offset == 0 {
+			t.Fatal("delayed message delivered before it is due")
+		}
+	}
+	if sub := waitSubscriptionOffset(t, p, addr, "later", "worker", 6); sub.Lag != 0 {
+		t.Fatalf("subscription %+v lags behind", sub)
+	}
+
+	received := make(chan *utils.HLCMsg, 6)
+	c := newTestConsumer(nil)
+	c.Subscription = "worker"
+	c.OnMessage = func(msg *utils.HLCMsg) { received <- msg }
+	go c.Subscribe(addr, "later", false)
+	select {
+	case msg := <-received:
+		if msg.Offset != 0 {
+			t.Fatalf("got offset %d again after reconnecting, want the delayed message", msg.Offset)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("delayed message not delivered after reconnecting")
+	}
+	select {
+	case msg := <-received:
+		t.Fatalf("got offset %d again after reconnecting", msg.Offset)
+	case <-time.After(200 * time.Millisecond):
+	}
+	c.Conn.Close()
+}
+
+// A durable subscription resumes right after the last message acknowledged
+// before the consumer disconnected
+func TestDurableSubscriptionResumes(t *testing.T) {
+	b, addr := startTestBroker(t, nil)
+	p := newTestProducer(nil)
+	publish := func(from, to int) {
+		t.Helper()
+		for i := from; i < to; i++ {
+			if err := p.Publish(addr, "orders", fmt.Sprintf("order-%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	publish(0, 3)
+	consumeAcked(t, b, p, addr, "orders", "billing", 3, 3)
+	publish(3, 5)
+	// Replay only applies to a new subscription
+	for i, msg := range consumeAcked(t, b, p, addr, "orders", "billing", 2, 5) {
+		if want := fmt.Sprintf("order-%d", 3+i); msg.Text() != want {
+			t.Fatalf("resumed with %q, want %q", msg.Text(), want)
+		}
+	}
+}
+
+// The window takes messages up to the message and byte credit, a message
+// alone always fits, and acks free it in any order
+func TestWindowCredit(t *testing.T) {
+	w := &window{credit: utils.Credit{Messages: 3, Bytes: 100}}
+	add := func(offset uint64, size int) {
+		w.deliveries = append(w.deliveries, &delivery{msg: &utils.HLCMsg{Offset: offset, Body: make([]byte, size)}})
+		w.bytes += size
+	}
+
+	if !w.fits(500) {
+		t.Fatal("a message larger than the byte credit does not fit an empty window")
+	}
+	add(0, 40)
+	add(1, 40)
+	if w.fits(40) || !w.fits(20) {
+		t.Fatal("byte credit not applied")
+	}
+	add(2, 20)
+	if !w.full() {
+		t.Fatal("window with 3 messages in flight is not full")
+	}
+
+	offset := uint64(1)
+	if d := w.remove(&offset); d == nil || d.msg.Offset != 1 {
+		t.Fatalf("removed %v, want offset 1", d)
+	}
+	if w.bytes != 60 || w.full() || !w.fits(40) {
+		t.Fatalf("window holds %d bytes after an ack out of order", w.bytes)
+	}
+	if d := w.remove(nil); d == nil || d.msg.Offset != 0 {
+		t.Fatalf("removed %v, want the oldest delivery", d)
+	}
+	if d := w.remove(&offset); d != nil {
+		t.Fatalf("removed offset 1 twice")
+	}
+}
+
+// Without credit, the broker pushes one message at a time
+func TestWindowDefaultCredit(t *testing.T) {
+	w := &window{}
+	w.deliveries = append(w.deliveries, &delivery{msg: &utils.HLCMsg{}})
+	if !w.full() {
+		t.Fatal("window without credit takes more than one message")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt, want := range map[int]time.Duration{
+		1:  retryBackoff,
+		2:  2 * retryBackoff,
+		3:  4 * retryBackoff,
+		20: maxRetryBackoff,
+	} {
+		if got := backoff(attempt); got != want {
+			t.Errorf("backoff of attempt %d is %s, want %s", attempt, got, want)
+		}
+	}
+}
+
+// A nacked message comes back after the backoff of its attempt, or after the
+// delay asked by the consumer, and a rejected one is dropped
+func TestNackRedelivery(t *testing.T) {
+	_, addr := startTestBroker(t, nil)
+	p := newTestProducer(nil)
+	for _, body := range []string{"retry", "requeue", "reject", "last"} {
+		if err := p.Publish(addr, "nacks", body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type delivered struct {
+		body    string
+		attempt int
+		at      time.Time
+	}
+	received := make(chan delivered, 8)
+	c := newTestConsumer(nil)
+	c.Handler = func(msg *utils.HLCMsg) error {
+		received <- delivered{msg.Text(), msg.Attempt, time.Now()}
+		if msg.Attempt > 1 {
+			return nil
+		}
+		switch msg.Text() {
+		case "retry":
+			return errors.New("failed")
+		case "requeue":
+			return GoMQ.Requeue(errors.New("busy"), 100*time.Millisecond)
+		case "reject":
+			return GoMQ.Reject(errors.New("invalid"))
+		}
+		return nil
+	}
+	go c.Subscribe(addr, "nacks", true)
+	defer func() { c.Conn.Close() }()
+
+	first := make(map[string]time.Time)
+	var order []string
+	for len(order) < 6 {
+		select {
+		case d := <-received:
+			order = append(order, fmt.Sprintf("%s/%d", d.body, d.attempt))
+			if d.attempt == 1 {
+				first[d.body] = d.at
+				continue
+			}
+			wait := d.at.Sub(first[d.body])
+			if d.body == "retry" && wait < retryBackoff-50*time.Millisecond {
+				t.Errorf("nacked message came back after %s, want the %s backoff", wait, retryBackoff)
+			}
+			if d.body == "requeue" && wait >= retryBackoff {
+				t.Errorf("requeued message came back after %s, want 100ms", wait)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("received %v", order)
+		}
+	}
+	for _, want := range []string{"retry/2", "requeue/2", "last/1"} {
+		if !slices.Contains(order, want) {
+			t.Errorf("received %v, missing %s", order, want)
+		}
+	}
+	select {
+	case d := <-received:
+		t.Errorf("received %s again on attempt %d after %v", d.body, d.attempt, order)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// A delayed message is held until it is due, the messages after it go first
+func TestScheduledDelivery(t *testing.T) {
+	_, addr := startTestBroker(t, nil)
+	p := newTestProducer(nil)
+	const delay = 300 * time.Millisecond
+	published := time.Now()
+	if _, err := p.PublishMessage(addr, "later", &utils.HLCMsg{Body: []byte("later"), Delay: delay}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Publish(addr, "later", "now"); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := consumeN(t, newTestConsumer(nil), addr, "later", 2)
+	if messages[0].Text() != "now" || messages[1].Text() != "later" {
+		t.Fatalf("received %q then %q, want now then later", messages[0].Text(), messages[1].Text())
+	}
+	if due := time.Unix(0, messages[1].DeliverAt); due.Before(published.Add(delay)) || time.Now().Before(due) {
+		t.Fatalf("delayed message due at %s delivered at %s", due, time.Now())
+	}
+}
+
+// A message expired before it reaches a consumer is skipped and counted
+func TestExpiredMessageNotDelivered(t *testing.T) {
+	_, addr := startTestBroker(t, nil)
+	p := newTestProducer(nil)
+	if err := p.SetTopicConfig(addr, "ttl", utils.TopicConfig{DefaultTTL: 50 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Publish(addr, "ttl", "stale"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.PublishMessage(addr, "ttl", &utils.HLCMsg{Body: []byte("fresh"), TTL: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if msg := consumeN(t, newTestConsumer(nil), addr, "ttl", 1)[0]; msg.Text() != "fresh" {
+		t.Fatalf("received %q, want the message not expired", msg.Text())
+	}
+	stats, err := p.TopicStats(addr, "ttl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats[0].ExpiredDropped != 1 {
+		t.Fatalf("%d expired messages dropped, want 1", stats[0].ExpiredDropped)
+	}
+}
+
+// Binary bodies, content types and headers reach consumers as published
+func TestBinaryMessageWithHeaders(t *testing.T) {
+	_, addr := startTestBroker(t, nil)
+	body := []byte{0, 0xff, 0xfe, '\n', 0}
+	_, err := newTestProducer(nil).PublishMessage(addr, "blobs", &utils.HLCMsg{
+		Body:        body,
+		ContentType: "application/octet-stream",
+		Headers:     map[string]string{"trace-id": "abc"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := consumeN(t, newTestConsumer(nil), addr, "blobs", 1)[0]
+	if !bytes.Equal(msg.Body, body) || msg.ContentType != "application/octet-stream" || msg.Headers["trace-id"] != "abc" {
+		t.Fatalf("received %+v", msg)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"time"
+
+	"github.com/MorElf7/GoMQ/utils"
+)
+
+// Content size of a fetch response when the consumer does not set one
+const defaultFetchMaxBytes = 1024 * 1024
+
+// Answer the fetch requests of a pull consumer. The messages of a response
+// stay in flight until the next fetch acknowledges them, they go back to the
+// pending messages if the consumer leaves before that.
+func (b *Broker) serveFetch(ctx context.Context, conn net.Conn, topic, connectionId string, frames <-chan *utils.Frame) {
+	var batch []*utils.HLCMsg
+	defer func() {
+		for _, msg := range batch {
+			b.topicManager.Release(topic, connectionId, msg)
+		}
+	}()
+
+	for {
+		var frame *utils.Frame
+		select {
+		case frame = <-frames:
+		case <-ctx.Done():
+			return
+		}
+
+		switch frame.Type {
+		case utils.FrameSeek:
+			// Seeking drops the messages in flight
+			batch = nil
+			b.handleSeek(conn, topic, connectionId, frame)
+		case utils.FrameFetch:
+			var req utils.FetchRequest
+			if err := utils.DecodeGobFrame(frame, &req); err != nil {
+				utils.WriteErrorFrame(conn, utils.ErrCodeBadRequest, "invalid fetch: %s", err)
+				continue
+			}
+			for _, msg := range batch {
+				if err := b.topicManager.Acknowledge(b.db, topic, connectionId, msg.Offset); err != nil {
+					b.logger.Error("Error committing offset of consumer %s: %s", connectionId, err)
+				}
+			}
+
+			var err error
+			batch, err = b.fetch(ctx, topic, connectionId, &req)
+			if errors.Is(err, utils.ErrFrameTooLarge) {
+				b.logger.Error("Error fetching topic %s for consumer %s: %s", topic, connectionId, err)
+				utils.WriteErrorFrame(conn, utils.ErrCodeFrameTooLarge, "%s", err)
+				continue
+			}
+			if err != nil {
+				b.logger.Error("Error reading topic %s: %s", topic, err)
+				utils.WriteErrorFrame(conn, utils.ErrCodeStorage, "%s", err)
+				continue
+			}
+			err = utils.WriteGobFrame(conn, utils.FrameFetchResponse, &utils.FetchResponse{Messages: batch})
+			if err != nil {
+				utils.HandleNetworkErrorByPeer(b.logger, err)
+				return
+			}
+		default:
+			b.logger.Error("Unexpected frame type %d from pull consumer %s", frame.Type, connectionId)
+		}
+	}
+}
+
+// Take the next messages of a consumer for a fetch response, waiting up to
+// req.Wait for the first one. The response fits in a frame the consumer can
+// read, a next message too large for one fails with ErrFrameTooLarge and stays
+// pending.
+func (b *Broker) fetch(ctx context.Context, topic, connectionId string, req *utils.FetchRequest) ([]*utils.HLCMsg, error) {
+	_, consumer, exists := b.topicManager.GetConnection(topic, connectionId)
+	if !exists {
+		return nil, nil
+	}
+	pendingMessage := consumer.PendingMessage
+
+	limit := max(req.Max, 1)
+	maxBytes := req.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultFetchMaxBytes
+	}
+	frameSize := int(req.MaxFrameSize)
+	if frameSize <= 0 {
+		frameSize = int(utils.DefaultMaxFrameSize)
+	}
+
+	var timeout <-chan time.Time
+	if req.Wait > 0 {
+		timer := time.NewTimer(req.Wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var batch []*utils.HLCMsg
+	size := 0
+	// Encoded size of the response, counted message by message as if each was
+	// alone in a response, which can only overestimate it
+	encoded := 0
+	for len(batch) < limit {
+		msg := pendingMessage.GetNextMessage()
+		if msg == nil {
+			n, err := b.topicManager.FillPending(b.db, topic, connectionId)
+			if err != nil && len(batch) == 0 {
+				return nil, err
+			}
+			if n > 0 {
+				continue
+			}
+			if len(batch) > 0 || timeout == nil {
+				break
+			}
+			select {
+			case <-pendingMessage.Ready():
+				continue
+			case <-timeout:
+			case <-ctx.Done():
+			}
+			break
+		}
+		if msg.Expired(time.Now()) {
+			if err := b.topicManager.DropExpired(b.db, b.logger, topic, connectionId, msg); err != nil {
+				b.logger.Error("Error committing offset of consumer %s: %s", connectionId, err)
+			}
+			continue
+		}
+		if len(batch) > 0 && size+len(msg.Body) > maxBytes {
+			pendingMessage.AddMessage(msg)
+			break
+		}
+		// Messages are shared with the other consumers of the topic, the
+		// attempt goes on a copy
+		out := *msg
+		_, out.Topic = utils.SplitTopic(topic)
+		// Measured before the attempt is known, the largest takes the most bytes
+		out.Attempt = math.MaxInt
+		msgSize, err := utils.GobFrameSize(&utils.FetchResponse{Messages: []*utils.HLCMsg{&out}})
+		if err == nil && encoded+msgSize > frameSize {
+			err = fmt.Errorf("%w: message at offset %d takes %d bytes, the consumer reads frames of up to %d", utils.ErrFrameTooLarge, msg.Offset, msgSize, frameSize)
+		}
+		if err != nil {
+			pendingMessage.AddMessage(msg)
+			if len(batch) > 0 {
+				break
+			}
+			return nil, err
+		}
+		out.Attempt = b.topicManager.Delivered(topic, connectionId, msg)
+		batch = append(batch, &out)
+		size += len(msg.Body)
+		encoded += msgSize
+	}
+	return batch, nil
+}
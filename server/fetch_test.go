@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/MorElf7/GoMQ/utils"
+)
+
+// Fetch responses fit in the frames the consumer reads, and a message too
+// large for one is reported instead of breaking the subscription
+func TestFetchFitsConsumerFrames(t *testing.T) {
+	_, addr := startTestBroker(t, nil)
+	p := newTestProducer(nil)
+	const messages = 10
+	for i := 0; i < messages; i++ {
+		if _, err := p.PublishWithAck(addr, "orders", strings.Repeat("x", 1000)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := p.PublishWithAck(addr, "orders", strings.Repeat("y", 10000)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.PublishWithAck(addr, "orders", "after"); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestConsumer(nil)
+	c.MaxFrameSize = 4096
+	c.FetchMaxBytes = 1024 * 1024
+	if err := c.SubscribePull(addr, "orders", utils.FromEarliest()); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var next uint64
+	for next < messages {
+		batch, err := c.Fetch(context.Background(), messages)
+		if err != nil {
+			t.Fatalf("fetch at offset %d: %v", next, err)
+		}
+		if len(batch) == 0 || len(batch) == messages {
+			t.Fatalf("fetched %d messages of 1000 bytes in frames of 4096 bytes", len(batch))
+		}
+		for _, msg := range batch {
+			if msg.Offset != next {
+				t.Fatalf("fetched offset %d, want %d", msg.Offset, next)
+			}
+			next++
+		}
+	}
+
+	_, err := c.Fetch(context.Background(), 1)
+	var brokerErr *utils.ErrorMessage
+	if !errors.As(err, &brokerErr) || brokerErr.Code != utils.ErrCodeFrameTooLarge {
+		t.Fatalf("fetch of a message larger than a frame returned %v", err)
+	}
+	// The subscription is still open, and can move past the message
+	if _, err := c.Seek(utils.FromOffset(messages + 1)); err != nil {
+		t.Fatal(err)
+	}
+	batch, err := c.Fetch(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch) != 1 || batch[0].Text() != "after" {
+		t.Fatalf("fetched %d messages after the seek", len(batch))
+	}
+}
+
+// Pushed messages are held to the frame size of the consumer too, a message
+// too large for its frames is reported instead of being sent
+func TestPushFitsConsumerFrames(t *testing.T) {
+	_, addr := startTestBroker(t, nil)
+	p := newTestProducer(nil)
+	for _, body := range []string{"small", strings.Repeat("y", 10000)} {
+		if _, err := p.PublishWithAck(addr, "orders", body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := newTestConsumer(nil)
+	c.MaxFrameSize = 4096
+	var received []string
+	c.EachMessage = func(msg string) { received = append(received, msg) }
+	err := c.Subscribe(addr, "orders", true)
+	var brokerErr *utils.ErrorMessage
+	if !errors.As(err, &brokerErr) || brokerErr.Code != utils.ErrCodeFrameTooLarge {
+		t.Fatalf("push of a message larger than a frame ended with %v", err)
+	}
+	if len(received) != 1 || received[0] != "small" {
+		t.Fatalf("received %d messages before the large one, want the small one", len(received))
+	}
+}
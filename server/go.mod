@@ -3,12 +3,13 @@ module github.com/MorElf7/GoMQ/server
 go 1.21.1
 
 require (
+	github.com/MorElf7/GoMQ/client v0.0.0-20240930032856-9cb0d6d5ba17
+	github.com/MorElf7/GoMQ/utils v0.0.0-20240930032513-f061cdca4531
 	github.com/dgraph-io/badger/v4 v4.3.0
 	github.com/google/uuid v1.6.0
 )
 
 require (
-	github.com/MorElf7/GoMQ/utils v0.0.0-20240930032513-f061cdca4531 // indirect
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/dgraph-io/ristretto v0.1.2-0.20240116140435-c67e07994f91 // indirect
 	github.com/dustin/go-humanize v1.0.1 // indirect
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	GoMQ "github.com/MorElf7/GoMQ/client"
+	"github.com/MorElf7/GoMQ/utils"
+)
+
+// The group starts at the position of its first member, a member joining it
+// later does not move it
+func TestGroupStartPositionOfLaterMember(t *testing.T) {
+	b, addr := startTestBroker(t, nil)
+	p := newTestProducer(nil)
+	for _, body := range []string{"old-0", "old-1", "old-2", "old-3", "old-4"} {
+		if _, err := p.PublishWithAck(addr, "orders", body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mu sync.Mutex
+	received := make(map[string]int)
+	got := make(chan struct{}, 16)
+	member := func(start utils.StartPosition) *GoMQ.Consumer {
+		c := newTestConsumer(nil)
+		c.Group = "billing"
+		c.OnMessage = func(msg *utils.HLCMsg) {
+			mu.Lock()
+			received[msg.Text()]++
+			mu.Unlock()
+			got <- struct{}{}
+		}
+		go c.SubscribeFrom(addr, "orders", start)
+		return c
+	}
+	wait := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			select {
+			case <-got:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("received %v", received)
+			}
+		}
+	}
+
+	member(utils.FromOffset(3))
+	wait(2)
+	member(utils.FromEarliest())
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pool, _ := b.topicManager.GetPool("orders")
+		pool.Mutex.RLock()
+		members := len(pool.Groups["billing"].Members)
+		pool.Mutex.RUnlock()
+		if members == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("second member did not join")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := p.PublishWithAck(addr, "orders", "new"); err != nil {
+		t.Fatal(err)
+	}
+	wait(1)
+	// Give a replay from the start the time to show up
+	time.Sleep(200 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := map[string]int{"old-3": 1, "old-4": 1, "new": 1}
+	if len(received) != len(want) {
+		t.Fatalf("group received %v, want %v", received, want)
+	}
+	for body, n := range want {
+		if received[body] != n {
+			t.Fatalf("group received %v, want %v", received, want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/MorElf7/GoMQ/utils"
+)
+
+// CPU time used by the process so far
+func cpuTime(t testing.TB) time.Duration {
+	t.Helper()
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		t.Fatal(err)
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// Idle subscriptions wait for a publish instead of polling, so hundreds of
+// them cost next to no CPU
+func TestIdleSubscriptionsCPU(t *testing.T) {
+	if testing.Short() {
+		t.Skip("measures CPU over a second")
+	}
+	const (
+		subscriptions = 300
+		idle          = time.Second
+		maxCPU        = 250 * time.Millisecond // Loose, the machine may be busy
+	)
+	b, addr := startTestBroker(t, nil)
+	if err := newTestProducer(nil).SetTopicConfig(addr, "idle", utils.TopicConfig{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < subscriptions; i++ {
+		c := newTestConsumer(nil)
+		c.EachMessage = func(string) {}
+		go c.Subscribe(addr, "idle", false)
+	}
+	// The subscriptions end when the broker shuts down
+	waitSubscriptions(t, b, "idle", subscriptions)
+
+	// Let the subscriptions settle before measuring
+	time.Sleep(100 * time.Millisecond)
+	before := cpuTime(t)
+	time.Sleep(idle)
+	used := cpuTime(t) - before
+	t.Logf("%d idle subscriptions used %s of CPU in %s", subscriptions, used, idle)
+	if used > maxCPU {
+		t.Fatalf("%d idle subscriptions used %s of CPU in %s, want at most %s", subscriptions, used, idle, maxCPU)
+	}
+}
+
+// Cost of b.N subscriptions, reported as the time and allocations to set
+// each one up and the CPU each one uses while idle
+func BenchmarkIdleSubscriptions(b *testing.B) {
+	const idle = 200 * time.Millisecond
+	broker, addr := startTestBroker(b, nil)
+	if err := newTestProducer(nil).SetTopicConfig(addr, "idle", utils.TopicConfig{}); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c := newTestConsumer(nil)
+		c.EachMessage = func(string) {}
+		go c.Subscribe(addr, "idle", false)
+	}
+	waitSubscriptions(b, broker, "idle", b.N)
+	b.StopTimer()
+
+	time.Sleep(50 * time.Millisecond)
+	before := cpuTime(b)
+	time.Sleep(idle)
+	used := cpuTime(b) - before
+	b.ReportMetric(float64(used.Nanoseconds())/float64(b.N)/idle.Seconds(), "cpu-ns/sub/s")
+}
+
+// A message larger than the byte credit left waits at the head of the pending
+// messages for an ack, without the subscription spinning on it
+func TestByteCreditBlockedIdle(t *testing.T) {
+	if testing.Short() {
+		t.Skip("measures CPU over half a second")
+	}
+	const (
+		messages = 3
+		idle     = 500 * time.Millisecond // Shorter than the ack timeout
+		maxCPU   = 50 * time.Millisecond
+	)
+	_, addr := startTestBroker(t, nil)
+	p := newTestProducer(nil)
+	for i := 0; i < messages; i++ {
+		if err := p.Publish(addr, "credit", fmt.Sprintf("%02d%058d", i, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	received := make(chan *utils.HLCMsg, messages)
+	release := make(chan struct{})
+	c := newTestConsumer(nil)
+	c.Credit = utils.Credit{Messages: 10, Bytes: 100}
+	c.Handler = func(msg *utils.HLCMsg) error {
+		received <- msg
+		<-release
+		return nil
+	}
+	go c.Subscribe(addr, "credit", true)
+	t.Cleanup(func() { c.Conn.Close() })
+
+	select {
+	case <-received:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no message received")
+	}
+	// The first message holds 60 bytes of the credit, the next one does not
+	// fit until it is acked
+	time.Sleep(50 * time.Millisecond)
+	before := cpuTime(t)
+	time.Sleep(idle)
+	used := cpuTime(t) - before
+	if used > maxCPU {
+		t.Fatalf("subscription out of byte credit used %s of CPU in %s, want at most %s", used, idle, maxCPU)
+	}
+
+	close(release)
+	for i := 1; i < messages; i++ {
+		select {
+		case msg := <-received:
+			if msg.Offset != uint64(i) {
+				t.Fatalf("message %d has offset %d, want %d", i, msg.Offset, i)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("received %d of %d messages", i, messages)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/MorElf7/GoMQ/utils"
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// An export larger than a frame is streamed in chunks and loads into another
+// store
+func TestExportNamespaceLargerThanAFrame(t *testing.T) {
+	_, addr := startTestBroker(t, nil)
+
+	p := newTestProducer(nil)
+	p.Namespace = "acme"
+	body := strings.Repeat("x", 100*1024)
+	const messages = 30
+	for i := 0; i < messages; i++ {
+		if _, err := p.PublishWithAck(addr, "orders", body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := newTestProducer(nil)
+	other.Namespace = "other"
+	if _, err := other.PublishWithAck(addr, "orders", "not exported"); err != nil {
+		t.Fatal(err)
+	}
+
+	var export bytes.Buffer
+	if err := newTestProducer(nil).ExportNamespace(addr, "acme", &export); err != nil {
+		t.Fatal(err)
+	}
+	if export.Len() <= 2*exportChunkSize {
+		t.Fatalf("export of %d bytes fits in two chunks", export.Len())
+	}
+
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Load(&export, 16); err != nil {
+		t.Fatal(err)
+	}
+	tm := utils.NewTopicManager(discardLogger())
+	tm.LoadPools(db, discardLogger())
+	pool, exists := tm.GetPool("acme::orders")
+	if !exists || pool.NextOffset != messages {
+		t.Fatalf("loaded export holds topic %v with %d messages, want %d", exists, pool.NextOffset, messages)
+	}
+	if _, exists := tm.GetPool("other::orders"); exists {
+		t.Fatal("export holds a topic of another namespace")
+	}
+
+	// The session goes on after the export
+	if err := newTestProducer(nil).ExportNamespace(addr, "missing", &export); err != nil {
+		t.Fatalf("export of an empty namespace: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MorElf7/GoMQ/utils"
+)
+
+// Every consumer of a topic gets every message once, in offset order, however
+// many producers publish to the topic at once
+func TestConcurrentProducersOrder(t *testing.T) {
+	const (
+		producers   = 8
+		perProducer = 100
+		consumers   = 4
+		total       = producers * perProducer
+	)
+	b, addr := startTestBroker(t, nil)
+
+	// Topics are created by producers
+	if err := newTestProducer(nil).SetTopicConfig(addr, "orders", utils.TopicConfig{}); err != nil {
+		t.Fatal(err)
+	}
+
+	received := make([][]*utils.HLCMsg, consumers)
+	var done sync.WaitGroup
+	for i := 0; i < consumers; i++ {
+		i := i
+		c := newTestConsumer(nil)
+		c.Credit = utils.Credit{Messages: 64}
+		done.Add(1)
+		c.OnMessage = func(msg *utils.HLCMsg) {
+			received[i] = append(received[i], msg)
+			if len(received[i]) == total {
+				done.Done()
+			}
+		}
+		go c.Subscribe(addr, "orders", false)
+		t.Cleanup(func() { c.Conn.Close() })
+	}
+	waitSubscriptions(t, b, "orders", consumers)
+
+	var publish sync.WaitGroup
+	errs := make(chan error, producers)
+	for p := 0; p < producers; p++ {
+		p := p
+		publish.Add(1)
+		go func() {
+			defer publish.Done()
+			producer := newTestProducer(nil)
+			for n := 0; n < perProducer; n++ {
+				if _, err := producer.PublishWithAck(addr, "orders", fmt.Sprintf("%d-%d", p, n)); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	publish.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		done.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(20 * time.Second):
+		t.Fatal("consumers did not get every message")
+	}
+
+	for i, messages := range received {
+		next := make([]int, producers)
+		for want, msg := range messages {
+			if msg.Offset != uint64(want) {
+				t.Fatalf("consumer %d got offset %d at position %d", i, msg.Offset, want)
+			}
+			// Messages of one producer keep the order they were sent in
+			var p, n int
+			if _, err := fmt.Sscanf(msg.Text(), "%d-%d", &p, &n); err != nil {
+				t.Fatal(err)
+			}
+			if n != next[p] {
+				t.Fatalf("consumer %d got message %d of producer %d, want %d", i, n, p, next[p])
+			}
+			next[p]++
+		}
+	}
+}
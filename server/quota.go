@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/MorElf7/GoMQ/utils"
+)
+
+// Open connections of every client, to cap them
+type connectionCounter struct {
+	max     int // 0 for no limit
+	mu      sync.Mutex
+	clients map[string]int // Map of client to its open connections
+}
+
+// Count a new connection of the client, false if the client is at its limit
+func (c *connectionCounter) acquire(client string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.max > 0 && c.clients[client] >= c.max {
+		return false
+	}
+	c.clients[client]++
+	return true
+}
+
+func (c *connectionCounter) release(client string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.clients[client]--; c.clients[client] <= 0 {
+		delete(c.clients, client)
+	}
+}
+
+// Name quotas are kept under for a client, its principal or its host if it is
+// anonymous
+func clientKey(conn net.Conn, principal string) string {
+	if principal != "" {
+		return principal
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// Hold a publish back as long as the publish rates of the client, the
+// namespace and the topic require, or refuse it if that takes too long
+func (b *Broker) throttle(conn net.Conn, s *session, topic string, messages []*utils.HLCMsg) error {
+	wait, err := b.quotas.Throttle(s.client, topic, messages)
+	if err != nil {
+		b.logger.Error("Refused publish of client %s: %s", conn.RemoteAddr(), err)
+		return err
+	}
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-b.ctx.Done():
+	}
+	return nil
+}
@@ -2,9 +2,17 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/MorElf7/GoMQ/utils"
@@ -12,7 +20,78 @@ import (
 	"github.com/google/uuid"
 )
 
+// Time given to a client to complete the TLS handshake
+const tlsHandshakeTimeout = 10 * time.Second
+
+// Payload size of the frames a namespace export is streamed in
+const exportChunkSize = 1024 * 1024
+
+type Broker struct {
+	ctx          context.Context // Cancelled when the broker shuts down
+	db           *badger.DB
+	topicManager *utils.TopicManager
+	logger       *utils.LoggerType
+	maxFrameSize uint32
+	auth         utils.Authenticator // Checks the credentials of every handshake, nil lets every client in
+	acl          *utils.ACL          // Rights of the principals on the topics, nil allows everything
+	quotas       *utils.PublishQuotas
+	connections  *connectionCounter
+}
+
+// What the broker knows of a connected client
+type session struct {
+	principal string // Authenticated name of the client, or the name of its certificate if authentication is off
+	namespace string // Namespace picked at handshake, its topics are the only ones the client sees
+	client    string // Name the quotas of the client are kept under
+}
+
+// Qualified name of a topic given by the client
+func (s *session) topic(name string) (string, error) {
+	if err := utils.ValidateTopic(name); err != nil {
+		return "", err
+	}
+	return utils.QualifiedTopic(s.namespace, name), nil
+}
+
+// Name of a qualified topic as the client knows it
+func (s *session) name(topic string) string {
+	_, name := utils.SplitTopic(topic)
+	return name
+}
+
+// Whether a qualified topic belongs to the namespace of the client
+func (s *session) owns(topic string) bool {
+	namespace, _ := utils.SplitTopic(topic)
+	return namespace == s.namespace
+}
+
 func main() {
+	maxFrameSize := flag.Uint("max-frame-size", uint(utils.DefaultMaxFrameSize), "Max payload size in bytes of a single frame")
+	hotTailSize := flag.Int("hot-tail-size", utils.DefaultHotTailSize, "Number of recent messages per topic kept in memory, older ones are read from disk")
+	cleanInterval := flag.Duration("clean-interval", time.Minute, "How often expired messages and messages out of retention are deleted from disk, and compacted topics compacted")
+	tlsCert := flag.String("tls-cert", "", "Certificate file of the broker, the broker serves TLS if set together with -tls-key")
+	tlsKey := flag.String("tls-key", "", "Private key file of the broker certificate")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA file client certificates are verified against")
+	tlsRequireClientCert := flag.Bool("tls-require-client-cert", false, "Reject clients without a certificate signed by -tls-client-ca (mutual TLS)")
+	authTokens := flag.String("auth-tokens", "", "File of \"<principal> <token>\" lines, clients must present one of the tokens")
+	authJWTKey := flag.String("auth-jwt-key", "", "File holding the HMAC key of the JWTs clients present as token")
+	authJWTIssuer := flag.String("auth-jwt-issuer", "", "Issuer the JWTs must carry, not checked if empty")
+	authJWTAudience := flag.String("auth-jwt-audience", "", "Audience the JWTs must carry, not checked if empty")
+	aclFile := flag.String("acl", "", "ACL file granting principals publish, consume and admin rights on topics, everything is allowed if empty")
+	aclReload := flag.Duration("acl-reload", 10*time.Second, "How often the ACL file is checked for changes")
+	quotaClientMessages := flag.Float64("quota-client-messages", 0, "Messages per second a client may publish, 0 for no limit")
+	quotaClientBytes := flag.Float64("quota-client-bytes", 0, "Message bytes per second a client may publish, 0 for no limit")
+	quotaNamespaceMessages := flag.Float64("quota-namespace-messages", 0, "Messages per second the topics of a namespace accept together, 0 for no limit")
+	quotaNamespaceBytes := flag.Float64("quota-namespace-bytes", 0, "Message bytes per second the topics of a namespace accept together, 0 for no limit")
+	quotaTopicMessages := flag.Float64("quota-topic-messages", 0, "Messages per second a topic accepts, 0 for no limit")
+	quotaTopicBytes := flag.Float64("quota-topic-bytes", 0, "Message bytes per second a topic accepts, 0 for no limit")
+	quotaMaxWait := flag.Duration("quota-max-wait", 5*time.Second, "Longest a publish over a rate is held back before it is refused")
+	quotaStoredBytes := flag.Int64("quota-topic-stored-bytes", 0, "Bytes a topic may store, publishes past it are refused, 0 for no limit")
+	quotaNamespaceStoredBytes := flag.Int64("quota-namespace-stored-bytes", 0, "Bytes the topics of a namespace may store together, publishes past it are refused, 0 for no limit")
+	quotaConnections := flag.Int("quota-connections", 0, "Connections a client may hold open, 0 for no limit")
+	quotaSubscriptions := flag.Int("quota-subscriptions", 0, "Subscriptions a topic accepts at once, a consumer group counts as one, 0 for no limit")
+	flag.Parse()
+
 	// Change log file location
 	var logger = utils.NewLogger("./log-broker.txt")
 	// Change port if needed
@@ -23,9 +102,45 @@ func main() {
 		logger.Error("Error starting TCP server: %s", err.Error())
 		os.Exit(1)
 	}
+	if *tlsCert != "" || *tlsKey != "" {
+		tlsConfig, err := utils.ServerTLSConfig(*tlsCert, *tlsKey, *tlsClientCA, *tlsRequireClientCert)
+		if err != nil {
+			logger.Error("Error loading TLS config: %s", err)
+			os.Exit(1)
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+		logger.Info("Serving TLS, client certificates: %s", tlsConfig.ClientAuth)
+	}
 	defer listener.Close()
 	logger.Info("Server is listening on port 8080")
 
+	// Authentication is on as soon as a token source is configured, a verified
+	// client certificate is then enough on its own
+	var auth utils.MultiAuthenticator
+	if *authTokens != "" {
+		tokens, err := utils.LoadTokenFile(*authTokens)
+		if err != nil {
+			logger.Error("Error loading token file: %s", err)
+			os.Exit(1)
+		}
+		auth = append(auth, tokens)
+	}
+	if *authJWTKey != "" {
+		key, err := os.ReadFile(*authJWTKey)
+		if err != nil {
+			logger.Error("Error loading JWT key: %s", err)
+			os.Exit(1)
+		}
+		auth = append(auth, &utils.JWTAuthenticator{
+			Key:      bytes.TrimSpace(key),
+			Issuer:   *authJWTIssuer,
+			Audience: *authJWTAudience,
+		})
+	}
+	if len(auth) > 0 && *tlsClientCA != "" {
+		auth = append(auth, utils.CertificateAuthenticator{})
+	}
+
 	db, err := badger.Open(badger.DefaultOptions("/tmp/badger"))
 	if err != nil {
 		logger.Error(err.Error())
@@ -35,146 +150,610 @@ func main() {
 
 	// Init variables for run
 	topicManager := utils.NewTopicManager(logger)
+	topicManager.HotTailSize = *hotTailSize
+	topicManager.MaxStoredBytes = *quotaStoredBytes
+	topicManager.MaxNamespaceStoredBytes = *quotaNamespaceStoredBytes
+	topicManager.MaxSubscriptions = *quotaSubscriptions
 	topicManager.LoadPools(db, logger)
 
+	// Stop accepting connections and cancel the subscriptions on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	broker := &Broker{
+		ctx:          ctx,
+		db:           db,
+		topicManager: topicManager,
+		logger:       logger,
+		maxFrameSize: uint32(*maxFrameSize),
+		quotas: &utils.PublishQuotas{
+			ClientMessages:    utils.NewRateLimiter(*quotaClientMessages),
+			ClientBytes:       utils.NewRateLimiter(*quotaClientBytes),
+			NamespaceMessages: utils.NewRateLimiter(*quotaNamespaceMessages),
+			NamespaceBytes:    utils.NewRateLimiter(*quotaNamespaceBytes),
+			TopicMessages:     utils.NewRateLimiter(*quotaTopicMessages),
+			TopicBytes:        utils.NewRateLimiter(*quotaTopicBytes),
+			MaxWait:           *quotaMaxWait,
+		},
+		connections: &connectionCounter{
+			max:     *quotaConnections,
+			clients: make(map[string]int),
+		},
+	}
+	if len(auth) > 0 {
+		broker.auth = auth
+		logger.Info("Clients must authenticate")
+	}
+	if *aclFile != "" {
+		broker.acl, err = utils.LoadACLFile(*aclFile)
+		if err != nil {
+			logger.Error("Error loading ACL file: %s", err)
+			os.Exit(1)
+		}
+		go broker.acl.Watch(ctx, *aclReload, logger)
+	}
+
+	go broker.clean(*cleanInterval)
+
 	fmt.Println("Broker listening on port 8080")
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				logger.Info("Broker shutting down")
+				return
+			}
 			logger.Error("Error accepting connection: %s", err.Error())
 			continue
 		}
-		go handleConnection(conn, db, topicManager, logger)
+		go broker.handleConnection(conn)
+	}
+}
+
+// Delete the expired messages and the messages out of the retention policy of
+// their topic, compact the compacted topics and recount the bytes they store,
+// every interval until the broker shuts down
+func (b *Broker) clean(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.topicManager.PurgeExpired(b.db, b.logger); err != nil {
+				b.logger.Error("Error purging expired messages: %s", err)
+			}
+			if err := b.topicManager.ApplyRetention(b.db, b.logger); err != nil {
+				b.logger.Error("Error applying retention: %s", err)
+			}
+			if err := b.topicManager.Compact(b.db, b.logger); err != nil {
+				b.logger.Error("Error compacting topics: %s", err)
+			}
+			if err := b.topicManager.CountStoredBytes(b.db); err != nil {
+				b.logger.Error("Error counting stored bytes: %s", err)
+			}
+		case <-b.ctx.Done():
+			return
+		}
+	}
+}
+
+// Read the next frame, any malformed frame is reported back to the client. The
+// connection can not go on after an oversize frame, its payload is not read.
+func (b *Broker) readFrame(conn net.Conn, reader io.Reader) (*utils.Frame, error) {
+	frame, err := utils.ReadFrame(reader, b.maxFrameSize)
+	if err != nil {
+		if err == io.EOF {
+			utils.HandleNetworkErrorByPeer(b.logger, err)
+			return nil, err
+		}
+		var opErr *net.OpError
+		if !errors.As(err, &opErr) {
+			b.logger.Error("Malformed frame from %s: %s", conn.RemoteAddr(), err)
+			utils.WriteErrorFrame(conn, utils.FrameErrorCode(err), "%s", err)
+		}
+		return nil, err
 	}
+	return frame, nil
 }
 
-func handleConnection(conn net.Conn, db *badger.DB, topicManager *utils.TopicManager, logger *utils.LoggerType) {
-	// defer conn.Close()
+func (b *Broker) handleConnection(conn net.Conn) {
+	// Finish the TLS handshake first so the client certificate is known
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			b.logger.Error("TLS handshake with %s failed: %s", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+	}
+	// Name of the client certificate, for authorization decisions
+	identity := utils.PeerCertificateIdentity(conn)
+	if identity != "" {
+		b.logger.Info("Client %s presented a certificate for %s", conn.RemoteAddr(), identity)
+	}
+
 	reader := bufio.NewReader(conn)
-	// writer := bufio.NewWriter(conn)
 
 	// Handshake phase
-	// 1 Mb buffer
-	buf := make([]byte, 1000000)
-	n, err := reader.Read(buf)
+	frame, err := b.readFrame(conn, reader)
 	if err != nil {
-		utils.HandleNetworkErrorByPeer(logger, err)
-		logger.Error("Error reading handshake: %s", err.Error())
+		b.logger.Error("Error reading handshake: %s", err.Error())
+		conn.Close()
+		return
+	}
+	if frame.Type != utils.FrameHandshake {
+		utils.WriteErrorFrame(conn, utils.ErrCodeBadRequest, "expected handshake frame, got type %d", frame.Type)
+		conn.Close()
+		return
 	}
 
-	msg, err := utils.MessageDecode(buf[:n])
-	// TODO: Add authentication
+	msg, err := utils.MessageDecode(frame.Payload)
+	if err != nil {
+		b.logger.Error("Error decoding handshake: %s", err.Error())
+		utils.WriteErrorFrame(conn, utils.ErrCodeBadRequest, "invalid handshake")
+		conn.Close()
+		return
+	}
+
+	principal := identity
+	if b.auth != nil {
+		principal, err = b.auth.Authenticate(&utils.AuthRequest{
+			Token:    msg.Metadata.Token,
+			Identity: identity,
+			Addr:     conn.RemoteAddr(),
+		})
+		if err != nil {
+			b.logger.Error("Rejected %s handshake from %s: %s", msg.Metadata.Role, conn.RemoteAddr(), err)
+			utils.WriteErrorFrame(conn, utils.ErrCodeUnauthenticated, "%s", err)
+			conn.Close()
+			return
+		}
+		b.logger.Info("Client %s authenticated as %s", conn.RemoteAddr(), principal)
+	}
+	if err := utils.ValidateNamespace(msg.Metadata.Namespace); err != nil {
+		utils.WriteErrorFrame(conn, utils.ErrCodeBadRequest, "%s", err)
+		conn.Close()
+		return
+	}
+	s := &session{principal: principal, namespace: msg.Metadata.Namespace, client: clientKey(conn, principal)}
+	if !b.connections.acquire(s.client) {
+		b.logger.Error("Refused %s connection from %s: client %s has %d connections open", msg.Metadata.Role, conn.RemoteAddr(), s.client, b.connections.max)
+		utils.WriteErrorFrame(conn, utils.ErrCodeQuotaExceeded, "%s: client %s has %d connections open", utils.ErrQuotaExceeded, s.client, b.connections.max)
+		conn.Close()
+		return
+	}
+	defer b.connections.release(s.client)
 
 	if msg.Metadata.Role == "producer" {
-		go handleProducer(conn, db, topicManager, &msg, logger)
+		b.handleProducer(conn, reader, s)
 	} else if msg.Metadata.Role == "consumer" {
-		go handleConsumer(conn, topicManager, &msg, logger)
+		b.handleConsumer(conn, reader, &msg, s)
 	} else {
+		utils.WriteErrorFrame(conn, utils.ErrCodeBadRequest, "unknown role %q", msg.Metadata.Role)
 		conn.Close()
 	}
 }
 
-func handleProducer(conn net.Conn, db *badger.DB, topicManager *utils.TopicManager, msg *utils.ClientMessage, logger *utils.LoggerType) {
+// Producer session, the connection stays open and every publish frame is
+// answered with an ack once the message is stored, or an error frame
+func (b *Broker) handleProducer(conn net.Conn, reader *bufio.Reader, s *session) {
 	defer conn.Close()
+	for {
+		frame, err := b.readFrame(conn, reader)
+		if err != nil {
+			if errors.Is(err, utils.ErrUnsupportedVersion) {
+				// Frame was skipped, the session can carry on
+				continue
+			}
+			// An oversize frame was reported and is not read, the session ends
+			return
+		}
+		switch frame.Type {
+		case utils.FramePublish:
+			err = b.handlePublish(conn, frame, s)
+		case utils.FramePublishBatch:
+			err = b.handlePublishBatch(conn, frame, s)
+		case utils.FrameAdmin:
+			err = b.handleAdmin(conn, frame, s)
+		default:
+			err = utils.WriteErrorFrame(conn, utils.ErrCodeBadRequest, "expected publish frame, got type %d", frame.Type)
+		}
+		if err != nil {
+			utils.HandleNetworkErrorByPeer(b.logger, err)
+			return
+		}
+	}
+}
+
+// Store a single message and ack it, only a failed write to the producer is
+// returned as an error
+func (b *Broker) handlePublish(conn net.Conn, frame *utils.Frame, s *session) error {
+	msg, err := utils.MessageDecode(frame.Payload)
+	if err != nil || msg.Payload == nil {
+		return utils.WriteErrorFrame(conn, utils.ErrCodeBadRequest, "invalid publish message")
+	}
+	topic, err := s.topic(msg.Metadata.Topic)
+	if err != nil {
+		return utils.WriteErrorFrame(conn, utils.ErrCodeBadRequest, "%s", err)
+	}
+	if err := b.authorize(conn, s, utils.OpPublish, topic); err != nil {
+		return utils.WriteErrorFrame(conn, utils.ErrCodeForbidden, "%s", err)
+	}
+
 	message := msg.Payload
-	id := uuid.New()
-	message.ID = id.String()
-	pool := topicManager.GetOrCreatePool(msg.Metadata.Topic)
-	pool.MessageLog.UpdateClock(message.Physical, message.Logical)
-	pool.MessageLog.AddMessage(message)
+	if err := b.throttle(conn, s, topic, []*utils.HLCMsg{message}); err != nil {
+		return utils.WriteErrorFrame(conn, utils.ErrCodeQuotaExceeded, "%s", err)
+	}
+	message.ID = uuid.New().String()
+	err = b.topicManager.PublishMessage(b.db, b.logger, topic, message)
+	if err != nil {
+		b.quotas.Cancel(s.client, topic, []*utils.HLCMsg{message})
+		return utils.WriteErrorFrame(conn, errorCode(err), "failed to store message: %s", err)
+	}
 
-	// Ack to client?
-	// writer := bufio.NewWriter(conn)
-	// writer.WriteString("Done")
-	// writer.Flush()
+	return utils.WriteGobFrame(conn, utils.FramePublishAck, &utils.PublishAck{
+		ID:       message.ID,
+		Physical: message.Physical,
+		Logical:  message.Logical,
+		Offset:   message.Offset,
+	})
+}
 
-	topicManager.PublishMessage(db, logger, msg.Metadata.Topic, message)
+// Store a whole batch in one go and ack every message of it
+func (b *Broker) handlePublishBatch(conn net.Conn, frame *utils.Frame, s *session) error {
+	var batch utils.PublishBatch
+	if err := utils.DecodeGobFrame(frame, &batch); err != nil {
+		return utils.WriteErrorFrame(conn, utils.ErrCodeBadRequest, "invalid publish batch")
+	}
+	topic, err := s.topic(batch.Topic)
+	if err != nil {
+		return utils.WriteErrorFrame(conn, utils.ErrCodeBadRequest, "%s", err)
+	}
+	if err := b.authorize(conn, s, utils.OpPublish, topic); err != nil {
+		return utils.WriteErrorFrame(conn, utils.ErrCodeForbidden, "%s", err)
+	}
+	for _, message := range batch.Messages {
+		if message == nil {
+			return utils.WriteErrorFrame(conn, utils.ErrCodeBadRequest, "invalid publish batch")
+		}
+		message.ID = uuid.New().String()
+	}
+	if err := b.throttle(conn, s, topic, batch.Messages); err != nil {
+		return utils.WriteErrorFrame(conn, utils.ErrCodeQuotaExceeded, "%s", err)
+	}
+
+	err = b.topicManager.PublishMessages(b.db, b.logger, topic, batch.Messages)
+	if err != nil {
+		b.quotas.Cancel(s.client, topic, batch.Messages)
+		return utils.WriteErrorFrame(conn, errorCode(err), "failed to store batch: %s", err)
+	}
+
+	batchAck := &utils.PublishBatchAck{Acks: make([]utils.PublishAck, len(batch.Messages))}
+	for i, message := range batch.Messages {
+		batchAck.Acks[i] = utils.PublishAck{
+			ID:       message.ID,
+			Physical: message.Physical,
+			Logical:  message.Logical,
+			Offset:   message.Offset,
+		}
+	}
+	return utils.WriteGobFrame(conn, utils.FramePublishBatchAck, batchAck)
+}
+
+// Run an admin command for a producer and send back the result
+func (b *Broker) handleAdmin(conn net.Conn, frame *utils.Frame, s *session) error {
+	var req utils.AdminRequest
+	if err := utils.DecodeGobFrame(frame, &req); err != nil {
+		return utils.WriteErrorFrame(conn, utils.ErrCodeBadRequest, "invalid admin request")
+	}
+	switch req.Command {
+	case utils.AdminListNamespaces, utils.AdminExportNamespace, utils.AdminDeleteNamespace:
+		return b.handleNamespaceAdmin(conn, &req, s)
+	}
+
+	// An empty topic stands for every topic of the namespace
+	topic := utils.QualifiedTopic(s.namespace, "")
+	if req.Topic != "" {
+		var err error
+		if topic, err = s.topic(req.Topic); err != nil {
+			return utils.WriteErrorFrame(conn, utils.ErrCodeBadRequest, "%s", err)
+		}
+	}
+	if err := b.authorize(conn, s, utils.OpAdmin, topic); err != nil {
+		return utils.WriteErrorFrame(conn, utils.ErrCodeForbidden, "%s", err)
+	}
+	if req.Topic == "" {
+		topic = ""
+	}
+
+	var resp utils.AdminResponse
+	var err error
+	switch req.Command {
+	case utils.AdminListSubscriptions:
+		var subs []utils.SubscriptionInfo
+		subs, err = b.topicManager.ListSubscriptions(b.db, topic)
+		for _, sub := range subs {
+			if s.owns(sub.Topic) {
+				sub.Topic = s.name(sub.Topic)
+				resp.Subscriptions = append(resp.Subscriptions, sub)
+			}
+		}
+	case utils.AdminResetSubscription:
+		err = b.topicManager.ResetSubscription(b.db, topic, req.Subscription, req.Offset)
+	case utils.AdminDeleteSubscription:
+		err = b.topicManager.DeleteSubscription(b.db, topic, req.Subscription)
+	case utils.AdminGetTopicConfig:
+		var config utils.TopicConfig
+		config, err = b.topicManager.TopicConfig(topic)
+		if config.DeadLetterTopic != "" {
+			config.DeadLetterTopic = s.name(config.DeadLetterTopic)
+		}
+		resp.Config = &config
+	case utils.AdminSetTopicConfig:
+		if req.Config == nil {
+			return utils.WriteErrorFrame(conn, utils.ErrCodeBadRequest, "missing topic config")
+		}
+		config := *req.Config
+		if config.DeadLetterTopic != "" {
+			// Dead letters stay in the namespace
+			if config.DeadLetterTopic, err = s.topic(config.DeadLetterTopic); err != nil {
+				return utils.WriteErrorFrame(conn, utils.ErrCodeBadRequest, "%s", err)
+			}
+		}
+		// The broker publishes dead letters for the client, so the client
+		// must be allowed to publish to the dead letter topic
+		if config.DeadLetterTopic != "" || config.MaxDeliveryAttempts > 0 {
+			if err := b.authorize(conn, s, utils.OpPublish, config.DeadLetterTopicFor(topic)); err != nil {
+				return utils.WriteErrorFrame(conn, utils.ErrCodeForbidden, "%s", err)
+			}
+		}
+		err = b.topicManager.SetTopicConfig(b.db, topic, config)
+	case utils.AdminRedrive:
+		// Messages go back to their topics on behalf of the client, under
+		// its publish rates. A run is only asked for once the run before it
+		// is stored, the tokens of the last run are given back if the
+		// re-drive fails after it.
+		var runTopic string
+		var run []*utils.HLCMsg
+		resp.Count, err = b.topicManager.Redrive(b.db, b.logger, topic, func(target string, messages []*utils.HLCMsg) error {
+			run = nil
+			if err := b.authorize(conn, s, utils.OpPublish, target); err != nil {
+				return err
+			}
+			if err := b.throttle(conn, s, target, messages); err != nil {
+				return err
+			}
+			runTopic, run = target, messages
+			return nil
+		})
+		if err != nil && run != nil {
+			b.quotas.Cancel(s.client, runTopic, run)
+		}
+	case utils.AdminTopicStats:
+		var stats []utils.TopicStats
+		stats, err = b.topicManager.TopicStats(topic)
+		for _, stat := range stats {
+			if s.owns(stat.Topic) {
+				stat.Topic = s.name(stat.Topic)
+				resp.Stats = append(resp.Stats, stat)
+			}
+		}
+	default:
+		return utils.WriteErrorFrame(conn, utils.ErrCodeBadRequest, "unknown admin command %q", req.Command)
+	}
+	if err != nil {
+		b.logger.Error("Admin command %s failed: %s", req.Command, err)
+		return utils.WriteErrorFrame(conn, errorCode(err), "%s", err)
+	}
+	b.logger.Info("Admin command %s done for topic %q subscription %q", req.Command, topic, req.Subscription)
+	return utils.WriteGobFrame(conn, utils.FrameAdminResponse, &resp)
+}
+
+// Run a command on whole namespaces, which takes admin rights on every topic
+func (b *Broker) handleNamespaceAdmin(conn net.Conn, req *utils.AdminRequest, s *session) error {
+	if err := b.authorize(conn, s, utils.OpAdmin, ""); err != nil {
+		return utils.WriteErrorFrame(conn, utils.ErrCodeForbidden, "%s", err)
+	}
+	if err := utils.ValidateNamespace(req.Namespace); err != nil {
+		return utils.WriteErrorFrame(conn, utils.ErrCodeBadRequest, "%s", err)
+	}
+
+	var resp utils.AdminResponse
+	var err error
+	switch req.Command {
+	case utils.AdminListNamespaces:
+		resp.Namespaces = b.topicManager.ListNamespaces()
+	case utils.AdminExportNamespace:
+		return b.exportNamespace(conn, req.Namespace)
+	case utils.AdminDeleteNamespace:
+		err = b.topicManager.DeleteNamespace(b.db, b.logger, req.Namespace)
+	}
+	if err != nil {
+		b.logger.Error("Admin command %s failed for namespace %q: %s", req.Command, req.Namespace, err)
+		return utils.WriteErrorFrame(conn, errorCode(err), "%s", err)
+	}
+	b.logger.Info("Admin command %s done for namespace %q", req.Command, req.Namespace)
+	return utils.WriteGobFrame(conn, utils.FrameAdminResponse, &resp)
 }
 
-func handleConsumer(conn net.Conn, topicManager *utils.TopicManager, msg *utils.ClientMessage, logger *utils.LoggerType) {
+// Stream the export of a namespace in export chunk frames, ended by an admin
+// response frame, or by an error frame if the export fails midway
+func (b *Broker) exportNamespace(conn net.Conn, namespace string) error {
+	w := utils.NewFrameWriter(conn, utils.FrameExportChunk, exportChunkSize)
+	err := utils.ExportNamespace(b.db, namespace, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		b.logger.Error("Admin command %s failed for namespace %q: %s", utils.AdminExportNamespace, namespace, err)
+		return utils.WriteErrorFrame(conn, errorCode(err), "%s", err)
+	}
+	b.logger.Info("Admin command %s done for namespace %q", utils.AdminExportNamespace, namespace)
+	return utils.WriteGobFrame(conn, utils.FrameAdminResponse, &utils.AdminResponse{})
+}
+
+// Check the ACL for an operation of a client on a topic, every denial is
+// logged
+func (b *Broker) authorize(conn net.Conn, s *session, op utils.Operation, topic string) error {
+	if b.acl == nil {
+		return nil
+	}
+	err := b.acl.Check(s.principal, op, topic)
+	if err != nil {
+		b.logger.Error("Denied client %s: %s", conn.RemoteAddr(), err)
+	}
+	return err
+}
+
+// Error code sent back to the client for an error of the topic manager
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, utils.ErrSubscriptionInUse):
+		return utils.ErrCodeInUse
+	case errors.Is(err, utils.ErrUnknownSubscription):
+		return utils.ErrCodeNotFound
+	case errors.Is(err, utils.ErrUnknownTopic):
+		return utils.ErrCodeUnknownTopic
+	case errors.Is(err, utils.ErrPositionDeleted):
+		return utils.ErrCodePositionDeleted
+	case errors.Is(err, utils.ErrMissingKey), errors.Is(err, utils.ErrInvalidNamespace), errors.Is(err, utils.ErrInvalidTopic):
+		return utils.ErrCodeBadRequest
+	case errors.Is(err, utils.ErrNamespaceInUse), errors.Is(err, utils.ErrNamespaceDeleting):
+		return utils.ErrCodeInUse
+	case errors.Is(err, utils.ErrQuotaExceeded):
+		return utils.ErrCodeQuotaExceeded
+	case errors.Is(err, utils.ErrForbidden):
+		return utils.ErrCodeForbidden
+	default:
+		return utils.ErrCodeStorage
+	}
+}
+
+// Move a consumer to the position of a seek frame and answer with the offset
+// of the next message it gets. Every message sent after the answer comes from
+// the new position.
+func (b *Broker) handleSeek(conn net.Conn, topic, connectionId string, frame *utils.Frame) {
+	var pos utils.StartPosition
+	if err := utils.DecodeGobFrame(frame, &pos); err != nil {
+		utils.WriteErrorFrame(conn, utils.ErrCodeBadRequest, "invalid seek: %s", err)
+		return
+	}
+	offset, err := b.topicManager.Seek(b.db, topic, connectionId, pos)
+	if err != nil {
+		b.logger.Error("Error seeking consumer %s of topic %s: %s", connectionId, topic, err)
+		utils.WriteErrorFrame(conn, errorCode(err), "%s", err)
+		return
+	}
+	b.logger.Info("Consumer %s of topic %s moved to offset %d", connectionId, topic, offset)
+	if err := utils.WriteGobFrame(conn, utils.FrameSeekAck, &utils.SeekAck{Offset: offset}); err != nil {
+		utils.HandleNetworkErrorByPeer(b.logger, err)
+	}
+}
+
+func (b *Broker) handleConsumer(conn net.Conn, reader *bufio.Reader, msg *utils.ClientMessage, s *session) {
 	defer conn.Close()
-	topic := msg.Metadata.Topic
+	logger := b.logger
+	topicManager := b.topicManager
+	topic, err := s.topic(msg.Metadata.Topic)
+	if err != nil {
+		utils.WriteErrorFrame(conn, utils.ErrCodeBadRequest, "%s", err)
+		return
+	}
 	replay := msg.Metadata.Replay
-	reader := bufio.NewReader(conn)
-	writer := bufio.NewWriter(conn)
-	pool, exist := topicManager.Pools[topic]
-	if !exist {
+	if err := b.authorize(conn, s, utils.OpConsume, topic); err != nil {
+		utils.WriteErrorFrame(conn, utils.ErrCodeForbidden, "%s", err)
+		return
+	}
+	if _, exist := topicManager.GetPool(topic); !exist {
+		utils.WriteErrorFrame(conn, utils.ErrCodeUnknownTopic, "topic %q does not exist", msg.Metadata.Topic)
 		return
 	}
 	id := uuid.New().String()
-	topicManager.SubscribeConsumer(topic, id, conn)
-	defer topicManager.UnsubscribeConsumer(topic, id)
-	if replay {
-		topicManager.ReplayMessageLog(topic, id)
+	subscription := msg.Metadata.Subscription
+	group := msg.Metadata.Group
+	pull := msg.Metadata.Pull
+	credit := msg.Metadata.Credit
+	// Connection holding the position of this consumer, shared by every member
+	// of a group
+	connectionId := id
+	start := msg.Metadata.Start
+	if group != "" {
+		var created bool
+		var err error
+		connectionId, created, err = topicManager.JoinGroup(b.db, logger, topic, group, id, conn, replay)
+		if errors.Is(err, utils.ErrPositionDeleted) {
+			logger.Error("Group %s of topic %s missed messages deleted by the retention policy: %s", group, topic, err)
+		} else if err != nil {
+			logger.Error("Error joining group %s of topic %s: %s", group, topic, err)
+			utils.WriteErrorFrame(conn, errorCode(err), "%s", err)
+			return
+		}
+		defer topicManager.LeaveGroup(logger, topic, group, id)
+		if !created && start.Kind != utils.StartDefault {
+			// Moving the shared cursor would take their messages from the
+			// members already in the group
+			logger.Info("Start position of member %s ignored, group %s of topic %s is already running", id, group, topic)
+			start = utils.StartPosition{}
+		}
+	} else if subscription != "" {
+		err := topicManager.SubscribeDurable(b.db, topic, subscription, id, conn, replay)
+		if errors.Is(err, utils.ErrPositionDeleted) {
+			logger.Error("Subscription %s of topic %s missed messages deleted by the retention policy: %s", subscription, topic, err)
+		} else if err != nil {
+			logger.Error("Error subscribing %s to topic %s: %s", subscription, topic, err)
+			utils.WriteErrorFrame(conn, errorCode(err), "%s", err)
+			return
+		}
+		defer topicManager.UnsubscribeConsumer(topic, id)
+	} else {
+		if err := topicManager.SubscribeConsumer(topic, id, conn); err != nil {
+			logger.Error("Error subscribing consumer %s to topic %s: %s", id, topic, err)
+			utils.WriteErrorFrame(conn, errorCode(err), "%s", err)
+			return
+		}
+		defer topicManager.UnsubscribeConsumer(topic, id)
+		if replay {
+			topicManager.ReplayMessageLog(topic, id)
+		}
 	}
-	pendingMessage := pool.Connections[id].PendingMessage
-	for {
-		msg := pendingMessage.GetNextMessage()
-		if msg == nil {
-			continue
-		} else {
-			clientMsg := &utils.ClientMessage{
-				Payload: msg,
-				Metadata: utils.Metadata{
-					Topic: topic,
-				},
-			}
-			msgEncode, err := utils.MessageEncode(clientMsg)
+	if start.Kind != utils.StartDefault {
+		if _, err := topicManager.Seek(b.db, topic, connectionId, start); err != nil {
+			logger.Error("Error moving consumer %s of topic %s to its start position: %s", id, topic, err)
+			utils.WriteErrorFrame(conn, errorCode(err), "%s", err)
+			return
+		}
+	}
+	// Every frame from the consumer is read here, the subscription is cancelled
+	// as soon as the consumer goes away or the broker shuts down
+	ctx, cancel := context.WithCancel(b.ctx)
+	defer cancel()
+	frames := make(chan *utils.Frame)
+	go func() {
+		defer cancel()
+		for {
+			frame, err := b.readFrame(conn, reader)
 			if err != nil {
-				logger.Error("Error decode message: %s", err)
-			}
-			maxRetries := 10
-			// Attempt sending messages
-			for attempt := 1; attempt <= maxRetries; attempt++ {
-				logger.Info("Attemp %d sending message to consumer id %s", attempt, id)
-				_, err := writer.Write(msgEncode)
-				if err != nil {
-					utils.HandleNetworkErrorByPeer(logger, err)
-				} else {
-
-					writer.Flush()
-
-					// Wait for acknowledgment with a timeout
-					ackCh := make(chan string)
-					timeoutCh := time.After(2 * time.Second)
-
-					go func() {
-						// Try to read acknowledgment from the consumer
-						ack, err := reader.ReadString('\n')
-						if err != nil {
-							utils.HandleNetworkErrorByPeer(logger, err)
-							close(ackCh)
-							return
-						}
-						ackCh <- ack
-					}()
-
-					// Wait for acknowledgment or timeout
-					flag := false
-					select {
-					case ack := <-ackCh:
-						if ack == "ACK\n" {
-							flag = true
-							logger.Info("Acknowledgment received for message ID: %v\n", msg.ID)
-						} else {
-							logger.Error("Failed to receive acknowledgment for message ID: %v\n", msg.ID)
-						}
-					case <-timeoutCh:
-						logger.Error("Timeout! No acknowledgment received for message ID: %v\n", msg.ID)
-					}
-
-					if flag {
-						break
-					}
-
-				}
-				if attempt == maxRetries {
-					// Reach Max Limit of failed attemps then close connection
-					logger.Info("Reach max attemp sending message to consumer id %s", id)
-					return
+				if errors.Is(err, utils.ErrUnsupportedVersion) {
+					continue
 				}
+				return
+			}
+			select {
+			case frames <- frame:
+			case <-ctx.Done():
+				return
 			}
-
 		}
+	}()
+
+	if pull {
+		b.serveFetch(ctx, conn, topic, connectionId, frames)
+	} else {
+		b.servePush(ctx, conn, topic, connectionId, id, frames, credit, msg.Metadata.MaxFrameSize)
 	}
 }
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MorElf7/GoMQ/utils"
+)
+
+// Certificate files written for a test
+type testCerts struct {
+	ca, brokerCert, brokerKey, clientCert, clientKey string
+}
+
+// Generate a CA, a broker certificate for 127.0.0.1 and a client certificate
+// for alice, all signed by the CA
+func generateCerts(t *testing.T) *testCerts {
+	t.Helper()
+	dir := t.TempDir()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certs := &testCerts{ca: filepath.Join(dir, "ca.pem")}
+	writePEM(t, certs.ca, "CERTIFICATE", caDER)
+	issue := func(name string, serial int64, usage x509.ExtKeyUsage, ips []net.IP) (string, string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  ips,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+		writePEM(t, certFile, "CERTIFICATE", der)
+		writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+		return certFile, keyFile
+	}
+	certs.brokerCert, certs.brokerKey = issue("broker", 2, x509.ExtKeyUsageServerAuth, []net.IP{net.IPv4(127, 0, 0, 1)})
+	certs.clientCert, certs.clientKey = issue("alice", 3, x509.ExtKeyUsageClientAuth, nil)
+	return certs
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSPublishAndConsume(t *testing.T) {
+	certs := generateCerts(t)
+	serverConfig, err := utils.ServerTLSConfig(certs.brokerCert, certs.brokerKey, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, addr := startTestBroker(t, serverConfig)
+	clientConfig, err := utils.ClientTLSConfig(certs.ca, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestProducer(clientConfig)
+	for _, body := range []string{"one", "two"} {
+		if _, err := p.PublishWithAck(addr, "orders", body); err != nil {
+			t.Fatalf("publish over TLS: %v", err)
+		}
+	}
+	messages := consumeN(t, newTestConsumer(clientConfig), addr, "orders", 2)
+	if messages[0].Text() != "one" || messages[1].Text() != "two" {
+		t.Fatalf("got %q and %q", messages[0].Text(), messages[1].Text())
+	}
+
+	// A client speaking plain TCP to a TLS broker gets nowhere
+	if _, err := newTestProducer(nil).PublishWithAck(addr, "orders", "plain"); err == nil {
+		t.Fatal("plain publish to a TLS broker succeeded")
+	}
+	// Nor does one that does not trust the broker certificate
+	untrusted := &tls.Config{MinVersion: tls.VersionTLS12}
+	if _, err := newTestProducer(untrusted).PublishWithAck(addr, "orders", "untrusted"); err == nil {
+		t.Fatal("publish without trusting the broker certificate succeeded")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	certs := generateCerts(t)
+	serverConfig, err := utils.ServerTLSConfig(certs.brokerCert, certs.brokerKey, certs.ca, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, addr := startTestBroker(t, serverConfig)
+	// Only alice may publish, so the publish only goes through if the broker
+	// took her name from the certificate
+	aclFile := filepath.Join(t.TempDir(), "acl.txt")
+	if err := os.WriteFile(aclFile, []byte("alice publish,consume *\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if b.acl, err = utils.LoadACLFile(aclFile); err != nil {
+		t.Fatal(err)
+	}
+
+	withCert, err := utils.ClientTLSConfig(certs.ca, certs.clientCert, certs.clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newTestProducer(withCert).PublishWithAck(addr, "orders", "from alice"); err != nil {
+		t.Fatalf("publish with a client certificate: %v", err)
+	}
+	messages := consumeN(t, newTestConsumer(withCert), addr, "orders", 1)
+	if messages[0].Text() != "from alice" {
+		t.Fatalf("got %q", messages[0].Text())
+	}
+
+	withoutCert, err := utils.ClientTLSConfig(certs.ca, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newTestProducer(withoutCert).PublishWithAck(addr, "orders", "anonymous"); err == nil {
+		t.Fatal("publish without a client certificate succeeded")
+	}
+}
+
+func TestServerTLSConfigNeedsClientCA(t *testing.T) {
+	certs := generateCerts(t)
+	if _, err := utils.ServerTLSConfig(certs.brokerCert, certs.brokerKey, "", true); err == nil {
+		t.Fatal("client certificates required without a client CA")
+	}
+}
+
+// A TLS client going away while the broker writes to it must not take the
+// broker down
+func TestTLSClientDisconnectDuringWrite(t *testing.T) {
+	certs := generateCerts(t)
+	serverConfig, err := utils.ServerTLSConfig(certs.brokerCert, certs.brokerKey, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, addr := startTestBroker(t, serverConfig)
+	clientConfig, err := utils.ClientTLSConfig(certs.ca, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestProducer(clientConfig)
+	for i := 0; i < 50; i++ {
+		if _, err := p.PublishWithAck(addr, "orders", "message"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		c := newTestConsumer(clientConfig)
+		c.Credit = utils.Credit{Messages: 50}
+		consumeN(t, c, addr, "orders", 1)
+	}
+	// The broker still serves
+	if _, err := p.PublishWithAck(addr, "orders", "after"); err != nil {
+		t.Fatalf("publish after consumers went away: %v", err)
+	}
+}
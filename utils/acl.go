@@ -0,0 +1,204 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rights a principal can be granted on topics
+type Operation string
+
+const (
+	OpPublish Operation = "publish"
+	OpConsume Operation = "consume"
+	OpAdmin   Operation = "admin" // Topic config, subscriptions, stats and re-drive
+)
+
+var ErrForbidden = errors.New("operation not allowed")
+
+// Grants a principal some operations on the topics matching a pattern. The
+// principal * matches every client, authenticated or not. In the topic
+// pattern * matches any run of characters, so orders.* is a prefix and *
+// matches every topic.
+type ACLRule struct {
+	Principal  string
+	Operations []Operation
+	Topic      string
+}
+
+func (r *ACLRule) allows(principal string, op Operation, topic string) bool {
+	if r.Principal != "*" && r.Principal != principal {
+		return false
+	}
+	for _, o := range r.Operations {
+		if o == op {
+			return matchTopic(r.Topic, topic)
+		}
+	}
+	return false
+}
+
+// Glob match where * matches any run of characters
+func matchTopic(pattern, topic string) bool {
+	head, rest, wildcard := strings.Cut(pattern, "*")
+	if !wildcard {
+		return pattern == topic
+	}
+	if !strings.HasPrefix(topic, head) {
+		return false
+	}
+	topic = topic[len(head):]
+	for i := 0; i <= len(topic); i++ {
+		if matchTopic(rest, topic[i:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Access control list loaded from a file. Everything not granted by a rule is
+// denied. The file can be reloaded while the broker runs, a file that does
+// not parse leaves the current rules in place.
+type ACL struct {
+	path    string
+	mu      sync.RWMutex
+	rules   []ACLRule
+	modTime time.Time
+}
+
+// Load an ACL file, one "<principal> <operations> <topic pattern>" rule per
+// line, operations separated by commas or "all". Empty lines and lines
+// starting with # are skipped.
+//
+//	alice  publish,consume  orders.*
+//	*      consume          public.*
+//	ops    all              *
+func LoadACLFile(path string) (*ACL, error) {
+	a := &ACL{path: path}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Read the ACL file again
+func (a *ACL) Reload() error {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return err
+	}
+	rules, err := parseACLFile(a.path)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.rules = rules
+	a.modTime = info.ModTime()
+	a.mu.Unlock()
+	return nil
+}
+
+func parseACLFile(path string) ([]ACLRule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var rules []ACLRule
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected <principal> <operations> <topic pattern>", path, line)
+		}
+		rule := ACLRule{Principal: fields[0], Topic: fields[2]}
+		for _, op := range strings.Split(fields[1], ",") {
+			switch Operation(op) {
+			case OpPublish, OpConsume, OpAdmin:
+				rule.Operations = append(rule.Operations, Operation(op))
+			case "all":
+				rule.Operations = append(rule.Operations, OpPublish, OpConsume, OpAdmin)
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown operation %q", path, line, op)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Whether the principal may run the operation on the topic. An empty topic
+// stands for every topic, only a * pattern grants it.
+func (a *ACL) Allowed(principal string, op Operation, topic string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	for i := range a.rules {
+		if a.rules[i].allows(principal, op, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Error for a denied operation, matching ErrForbidden
+func (a *ACL) Check(principal string, op Operation, topic string) error {
+	if a.Allowed(principal, op, topic) {
+		return nil
+	}
+	if topic == "" {
+		return fmt.Errorf("%w: %s on every topic for %q", ErrForbidden, op, principal)
+	}
+	return fmt.Errorf("%w: %s on topic %q for %q", ErrForbidden, op, topic, principal)
+}
+
+// Reload the file whenever it changes, checking every interval until ctx is
+// done
+func (a *ACL) Watch(ctx context.Context, interval time.Duration, logger *LoggerType) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			info, err := os.Stat(a.path)
+			if err != nil {
+				logger.Error("Error checking ACL file %s: %s", a.path, err)
+				continue
+			}
+			a.mu.RLock()
+			changed := !info.ModTime().Equal(a.modTime)
+			a.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := a.Reload(); err != nil {
+				logger.Error("Error reloading ACL file %s, keeping the current rules: %s", a.path, err)
+				// Do not retry until the file changes again
+				a.mu.Lock()
+				a.modTime = info.ModTime()
+				a.mu.Unlock()
+				continue
+			}
+			a.mu.RLock()
+			n := len(a.rules)
+			a.mu.RUnlock()
+			logger.Info("Reloaded ACL file %s, %d rules", a.path, n)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern, topic string
+		want           bool
+	}{
+		{"orders", "orders", true},
+		{"orders", "orders2", false},
+		{"orders", "order", false},
+		{"orders", "", false},
+		{"*", "orders", true},
+		{"*", "", true},
+		{"orders.*", "orders.eu", true},
+		{"orders.*", "orders.", true},
+		{"orders.*", "orders", false},
+		{"orders.*", "billing.orders.eu", false},
+		{"*.dlq", "orders.dlq", true},
+		{"*.dlq", "orders.dlq.old", false},
+		{"team-a::*", "team-a::orders", true},
+		{"team-a::*", "team-b::orders", false},
+		{"*::orders", "team-a::orders", true},
+		{"*::orders", "orders", false},
+		{"a*b*c", "abc", true},
+		{"a*b*c", "a-b-b-c", true},
+		{"a*b*c", "a-c-b", false},
+		{"**", "orders", true},
+		{"ord*rs", "orders", true},
+		{"ord*rs", "ordrs", true},
+		{"ord*rs", "ordersx", false},
+	}
+	for _, tt := range tests {
+		if got := matchTopic(tt.pattern, tt.topic); got != tt.want {
+			t.Errorf("matchTopic(%q, %q) = %v, want %v", tt.pattern, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestACLCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl.txt")
+	rules := "# comment\n\nalice publish,consume orders.*\nbob all billing\n* consume public\n"
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	acl, err := LoadACLFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		principal string
+		op        Operation
+		topic     string
+		want      bool
+	}{
+		{"alice", OpPublish, "orders.eu", true},
+		{"alice", OpConsume, "orders.eu", true},
+		{"alice", OpAdmin, "orders.eu", false},
+		{"alice", OpPublish, "billing", false},
+		{"bob", OpAdmin, "billing", true},
+		{"bob", OpPublish, "orders.eu", false},
+		{"", OpConsume, "public", true},
+		{"carol", OpConsume, "public", true},
+		{"carol", OpPublish, "public", false},
+	}
+	for _, tt := range tests {
+		if got := acl.Allowed(tt.principal, tt.op, tt.topic); got != tt.want {
+			t.Errorf("%q %s %s allowed %v, want %v", tt.principal, tt.op, tt.topic, got, tt.want)
+		}
+	}
+}
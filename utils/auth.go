@@ -0,0 +1,266 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+var ErrUnauthenticated = errors.New("authentication failed")
+
+// Reason a client was not authenticated, it matches ErrUnauthenticated
+type AuthError struct {
+	Reason string
+}
+
+func (e *AuthError) Error() string {
+	return ErrUnauthenticated.Error() + ": " + e.Reason
+}
+
+func (e *AuthError) Is(target error) bool {
+	return target == ErrUnauthenticated
+}
+
+// What a client presents at handshake
+type AuthRequest struct {
+	Token    string   // Metadata.Token of the handshake
+	Identity string   // Common name of the verified client certificate, empty without one
+	Addr     net.Addr // Address of the client
+}
+
+// Checks the credentials of a client at handshake and returns the name of the
+// principal it is authenticated as. A failure matches ErrUnauthenticated, and
+// is an *AuthError to report the reason.
+type Authenticator interface {
+	Authenticate(req *AuthRequest) (string, error)
+}
+
+// Authenticators tried in turn, the first one accepting the client wins. The
+// client is told why every one of them refused it.
+type MultiAuthenticator []Authenticator
+
+func (m MultiAuthenticator) Authenticate(req *AuthRequest) (string, error) {
+	reasons := make([]string, 0, len(m))
+	for _, a := range m {
+		principal, err := a.Authenticate(req)
+		if err == nil {
+			return principal, nil
+		}
+		var authErr *AuthError
+		if !errors.As(err, &authErr) {
+			return "", err
+		}
+		if !slices.Contains(reasons, authErr.Reason) {
+			reasons = append(reasons, authErr.Reason)
+		}
+	}
+	if len(reasons) == 0 {
+		reasons = append(reasons, "no authenticator")
+	}
+	return "", &AuthError{Reason: strings.Join(reasons, ", ")}
+}
+
+// Authenticates clients by their verified TLS client certificate, the
+// principal is the common name of the certificate
+type CertificateAuthenticator struct{}
+
+func (CertificateAuthenticator) Authenticate(req *AuthRequest) (string, error) {
+	if req.Identity == "" {
+		return "", &AuthError{Reason: "no client certificate"}
+	}
+	return req.Identity, nil
+}
+
+// Authenticates clients by a token out of a fixed list
+type StaticTokenAuthenticator struct {
+	tokens map[string]string // Map of token to principal
+}
+
+// Load a token file, one "<principal> <token>" pair per line. Empty lines and
+// lines starting with # are skipped.
+func LoadTokenFile(path string) (*StaticTokenAuthenticator, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	a := &StaticTokenAuthenticator{tokens: make(map[string]string)}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected <principal> <token>", path, line)
+		}
+		a.tokens[fields[1]] = fields[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *StaticTokenAuthenticator) Authenticate(req *AuthRequest) (string, error) {
+	if req.Token == "" {
+		return "", &AuthError{Reason: "no token"}
+	}
+	// Compare every token so the time taken does not tell how close a guess is
+	principal := ""
+	for token, p := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(req.Token)) == 1 {
+			principal = p
+		}
+	}
+	if principal == "" {
+		return "", &AuthError{Reason: "unknown token"}
+	}
+	return principal, nil
+}
+
+// Claims of a JWT checked by the broker, the subject is the principal
+type JWTClaims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"` // Unix seconds
+	NotBefore int64    `json:"nbf,omitempty"` // Unix seconds
+}
+
+// Audience claim of a JWT, a single string or a list of them
+type Audience []string
+
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+func (a Audience) contains(audience string) bool {
+	for _, aud := range a {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+}
+
+var jwtAlgorithms = map[string]func() hash.Hash{
+	"HS256": sha256.New,
+	"HS384": sha512.New384,
+	"HS512": sha512.New,
+}
+
+// Authenticates clients by a JWT signed with HMAC (HS256, HS384 or HS512)
+// under Key. Issuer and Audience are checked if set.
+type JWTAuthenticator struct {
+	Key      []byte
+	Issuer   string
+	Audience string
+	Leeway   time.Duration // Clock skew allowed on exp and nbf
+}
+
+func (a *JWTAuthenticator) Authenticate(req *AuthRequest) (string, error) {
+	if req.Token == "" {
+		return "", &AuthError{Reason: "no token"}
+	}
+	claims, err := a.verify(req.Token)
+	if err != nil {
+		return "", &AuthError{Reason: err.Error()}
+	}
+	return claims.Subject, nil
+}
+
+func (a *JWTAuthenticator) verify(token string) (*JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	newHash, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	mac := hmac.New(newHash, a.Key)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errors.New("invalid signature")
+	}
+
+	var claims JWTClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	switch {
+	case claims.Subject == "":
+		return nil, errors.New("missing subject")
+	case claims.ExpiresAt != 0 && now.After(time.Unix(claims.ExpiresAt, 0).Add(a.Leeway)):
+		return nil, errors.New("token expired")
+	case claims.NotBefore != 0 && now.Before(time.Unix(claims.NotBefore, 0).Add(-a.Leeway)):
+		return nil, errors.New("token not valid yet")
+	case a.Issuer != "" && claims.Issuer != a.Issuer:
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	case a.Audience != "" && !claims.Audience.contains(a.Audience):
+		return nil, fmt.Errorf("token not meant for audience %q", a.Audience)
+	}
+	return &claims, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+// Sign claims into an HS256 JWT, for clients and tools holding the key
+func SignJWT(key []byte, claims *JWTClaims) (string, error) {
+	header, err := json.Marshal(&jwtHeader{Alg: "HS256", Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// JWT of any header algorithm, signed with the HMAC of alg if it has one
+func signTestJWT(t *testing.T, key []byte, alg string, claims any) string {
+	t.Helper()
+	header, err := json.Marshal(&jwtHeader{Alg: alg, Typ: "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	var signature []byte
+	if newHash, ok := jwtAlgorithms[alg]; ok {
+		mac := hmac.New(newHash, key)
+		mac.Write([]byte(unsigned))
+		signature = mac.Sum(nil)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	key := []byte("secret")
+	now := time.Now()
+	auth := &JWTAuthenticator{Key: key, Issuer: "gomq", Audience: "broker", Leeway: time.Minute}
+	valid := func() *JWTClaims {
+		return &JWTClaims{Subject: "alice", Issuer: "gomq", Audience: Audience{"broker"}, ExpiresAt: now.Add(time.Hour).Unix()}
+	}
+	with := func(change func(c *JWTClaims)) *JWTClaims {
+		c := valid()
+		change(c)
+		return c
+	}
+	signed, err := SignJWT(key, valid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(signed, ".")
+
+	tests := []struct {
+		name   string
+		token  string
+		reason string // Empty if the token is accepted
+	}{
+		{"HS256", signed, ""},
+		{"HS384", signTestJWT(t, key, "HS384", valid()), ""},
+		{"HS512", signTestJWT(t, key, "HS512", valid()), ""},
+		{"audience in a list", signTestJWT(t, key, "HS256", with(func(c *JWTClaims) { c.Audience = Audience{"other", "broker"} })), ""},
+		{"expired within leeway", signTestJWT(t, key, "HS256", with(func(c *JWTClaims) { c.ExpiresAt = now.Add(-30 * time.Second).Unix() })), ""},
+		{"no token", "", "no token"},
+		{"malformed", "not-a-jwt", "malformed token"},
+		{"undecodable header", "!!!." + parts[1] + "." + parts[2], "malformed token"},
+		{"unsupported algorithm", signTestJWT(t, key, "none", valid()), "unsupported algorithm"},
+		{"bad signature", parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString([]byte("forged")), "invalid signature"},
+		{"malformed signature", parts[0] + "." + parts[1] + ".!!!", "malformed signature"},
+		{"other key", signTestJWT(t, []byte("other"), "HS256", valid()), "invalid signature"},
+		{"missing subject", signTestJWT(t, key, "HS256", with(func(c *JWTClaims) { c.Subject = "" })), "missing subject"},
+		{"expired", signTestJWT(t, key, "HS256", with(func(c *JWTClaims) { c.ExpiresAt = now.Add(-time.Hour).Unix() })), "token expired"},
+		{"not valid yet", signTestJWT(t, key, "HS256", with(func(c *JWTClaims) { c.NotBefore = now.Add(time.Hour).Unix() })), "not valid yet"},
+		{"wrong issuer", signTestJWT(t, key, "HS256", with(func(c *JWTClaims) { c.Issuer = "other" })), "unexpected issuer"},
+		{"wrong audience", signTestJWT(t, key, "HS256", with(func(c *JWTClaims) { c.Audience = Audience{"other"} })), "not meant for audience"},
+		{"no audience", signTestJWT(t, key, "HS256", with(func(c *JWTClaims) { c.Audience = nil })), "not meant for audience"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal, err := auth.Authenticate(&AuthRequest{Token: tt.token})
+			if tt.reason == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if principal != "alice" {
+					t.Fatalf("authenticated as %q, want alice", principal)
+				}
+				return
+			}
+			if !errors.Is(err, ErrUnauthenticated) || !strings.Contains(err.Error(), tt.reason) {
+				t.Fatalf("got error %v, want %q", err, tt.reason)
+			}
+		})
+	}
+}
+
+// A single string audience decodes like a list of one
+func TestAudienceSingleString(t *testing.T) {
+	var claims JWTClaims
+	if err := json.Unmarshal([]byte(`{"sub":"alice","aud":"broker"}`), &claims); err != nil {
+		t.Fatal(err)
+	}
+	if !claims.Audience.contains("broker") {
+		t.Fatalf("audience %q", claims.Audience)
+	}
+}
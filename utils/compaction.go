@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Default time a tombstone stays in a compacted topic, long enough for every
+// consumer to see the key go away
+const DefaultTombstoneRetention = 24 * time.Hour
+
+var ErrMissingKey = errors.New("messages of a compacted topic need a key")
+
+// How long tombstones of the topic are kept
+func (c *TopicConfig) tombstoneRetention() time.Duration {
+	if c.TombstoneRetention > 0 {
+		return c.TombstoneRetention
+	}
+	return DefaultTombstoneRetention
+}
+
+// Compact every compacted topic, only the newest message of each key is kept
+// and tombstones are deleted once past their retention. Messages not due yet
+// are left alone, they replace nothing before they are delivered.
+func (tm *TopicManager) Compact(db *badger.DB, logger *LoggerType) error {
+	tm.Mutex.RLock()
+	pools := make([]*TopicPool, 0, len(tm.Pools))
+	for _, pool := range tm.Pools {
+		pools = append(pools, pool)
+	}
+	tm.Mutex.RUnlock()
+
+	for _, pool := range pools {
+		pool.Mutex.RLock()
+		config := pool.Config
+		first, end := pool.FirstOffset, pool.NextOffset
+		pool.Mutex.RUnlock()
+		if !config.Compacted || first >= end {
+			continue
+		}
+
+		oldest := time.Now().Add(-config.tombstoneRetention()).UnixNano()
+		newest, err := newestKeys(db, pool, first, end)
+		if err != nil {
+			return err
+		}
+		compacted := 0
+		for from := first; from < end; {
+			obsolete, next, err := compactableMessages(db, pool, newest, from, end, oldest)
+			if err != nil {
+				return err
+			}
+			from = next
+			if len(obsolete) == 0 {
+				continue
+			}
+
+			// Drop them from the hot tail first, consumers stop reading them
+			offsets := make([]uint64, len(obsolete))
+			for i, message := range obsolete {
+				offsets[i] = message.Offset
+			}
+			pool.Mutex.Lock()
+			pool.MessageLog.Remove(offsets)
+			pool.Mutex.Unlock()
+
+			if err := deleteCompacted(db, pool.Topic, obsolete); err != nil {
+				return err
+			}
+			pool.compacted.Add(uint64(len(obsolete)))
+			compacted += len(obsolete)
+		}
+		if compacted > 0 {
+			logger.Info("Compacted %d messages of topic %s", compacted, pool.Topic)
+		}
+	}
+	return nil
+}
+
+// Offset of the newest message of each key of a topic in [first, end), only
+// the keys and metadata of the messages are read
+func newestKeys(db *badger.DB, pool *TopicPool, first, end uint64) (map[string]uint64, error) {
+	newest := make(map[string]uint64)
+	err := db.View(func(txn *badger.Txn) error {
+		return iterateMessageMeta(txn, pool.Topic, first, end, func(message *messageMeta) error {
+			if message.Key != "" && !pool.Schedule.Holds(message.Offset) {
+				newest[message.Key] = message.Offset
+			}
+			return nil
+		})
+	})
+	return newest, err
+}
+
+// Up to purgeBatchSize messages of a topic from offset from replaced by a
+// newer message of the same key, and tombstones stamped before oldest. Return
+// them with the offset to go on from.
+func compactableMessages(db *badger.DB, pool *TopicPool, newest map[string]uint64, from, end uint64, oldest int64) ([]*messageMeta, uint64, error) {
+	var obsolete []*messageMeta
+	next := end
+	err := db.View(func(txn *badger.Txn) error {
+		return iterateMessageMeta(txn, pool.Topic, from, end, func(message *messageMeta) error {
+			if message.Key == "" || pool.Schedule.Holds(message.Offset) {
+				return nil
+			}
+			if newest[message.Key] != message.Offset || (message.Tombstone && message.Physical < oldest) {
+				obsolete = append(obsolete, message)
+				if len(obsolete) == purgeBatchSize {
+					next = message.Offset + 1
+					return errStopIteration
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil && err != errStopIteration {
+		return nil, 0, err
+	}
+	return obsolete, next, nil
+}
+
+// Delete compacted messages from the store together with their index entries
+func deleteCompacted(db *badger.DB, topic string, messages []*messageMeta) error {
+	return db.Update(func(txn *badger.Txn) error {
+		for _, message := range messages {
+			if err := deleteMessage(txn, topic, message); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
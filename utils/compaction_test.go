@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Compaction goes through the topic in batches and deletes the index entries
+// of the messages it replaces
+func TestCompactInBatches(t *testing.T) {
+	db := openTestDB(t)
+	logger := testLogger()
+	tm := NewTopicManager(logger)
+	if err := tm.SetTopicConfig(db, "prices", TopicConfig{Compacted: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	const total = 2*purgeBatchSize + 5
+	later := time.Now().Add(time.Hour).UnixNano()
+	messages := make([]*HLCMsg, total)
+	for i := range messages {
+		messages[i] = &HLCMsg{
+			Key:       fmt.Sprintf("k%d", i%3),
+			Body:      []byte(fmt.Sprintf("price %d", i)),
+			ExpiresAt: later,
+		}
+	}
+	if err := tm.PublishMessages(db, logger, "prices", messages); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tm.Compact(db, logger); err != nil {
+		t.Fatal(err)
+	}
+	for prefix, want := range map[string]int{messageKeyPrefix: 3, expiryKeyPrefix: 3} {
+		if n := countKeys(t, db, prefix); n != want {
+			t.Errorf("%d keys left under %s, want %d", n, prefix, want)
+		}
+	}
+	stats, err := tm.TopicStats("prices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats[0].Compacted != total-3 {
+		t.Fatalf("compacted %d messages, want %d", stats[0].Compacted, total-3)
+	}
+	kept, err := readMessages(db, "prices", 0, total)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, message := range kept {
+		if want := uint64(total - 3 + i); message.Offset != want {
+			t.Errorf("kept offset %d, want %d", message.Offset, want)
+		}
+	}
+}
@@ -1,36 +1,197 @@
 package utils
 
 import (
+	"errors"
+	"io"
 	"net"
-	"os"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"syscall"
 
 	"github.com/dgraph-io/badger/v4"
 )
 
+// Max number of messages waiting in memory for a consumer. Past that the
+// consumer is lagging and its next messages are read from the topic log.
+const maxPendingMessages = 256
+
 type ConsumerConnection struct {
 	ID   string   // Unique identifier for the consumer
 	Conn net.Conn // The network connection (e.g., TCP, WebSocket)
 	// Offset         HLCMsg        // The last delivered message for this consumer
 	PendingMessage *MessageQueue // Message pending to be delivered
 	// Active         bool          // Show status of connection
+	NextOffset   uint64             // Offset of the next message to add to PendingMessage
+	Subscription string             // Name of the durable subscription or group, empty for a one off consumer
+	inflight     map[uint64]*HLCMsg // Messages sent to the consumer and not acknowledged yet
+	attempts     *deliveryAttempts  // Number of sends of the messages not acknowledged yet
+	held         map[uint64]*HLCMsg // Scheduled messages skipped by the consumer, handed over once due
+	delayed      map[uint64]bool    // Scheduled messages not acknowledged yet, the committed offset moves past them
+	committed    uint64             // Last position stored for a durable subscription
+	group        bool               // Shared by the members of a consumer group
+	mu           sync.Mutex         // Guard NextOffset, inflight and the filling of PendingMessage
+}
+
+func newConsumerConnection(id string, conn net.Conn, nextOffset uint64) *ConsumerConnection {
+	return &ConsumerConnection{
+		ID:             id,
+		Conn:           conn,
+		PendingMessage: NewMessageQueue(),
+		NextOffset:     nextOffset,
+		inflight:       make(map[uint64]*HLCMsg),
+		attempts:       newDeliveryAttempts(),
+		held:           make(map[uint64]*HLCMsg),
+		delayed:        make(map[uint64]bool),
+		committed:      nextOffset,
+	}
+}
+
+// Offset of the first message not acknowledged yet, whether it is in flight,
+// pending, or not read from the topic log yet. Scheduled messages do not hold
+// the committed offset back, a durable subscription stores them apart until
+// they are acknowledged. Must be called with mu held.
+func (c *ConsumerConnection) committedOffset() uint64 {
+	committed := c.NextOffset
+	offset, found := c.PendingMessage.FirstOffset(func(msg *HLCMsg) bool {
+		return !c.delayed[msg.Offset]
+	})
+	if found && offset < committed {
+		committed = offset
+	}
+	for offset := range c.inflight {
+		if !c.delayed[offset] && offset < committed {
+			committed = offset
+		}
+	}
+	return committed
+}
+
+// Scheduled messages before the committed offset and not acknowledged yet, in
+// offset order. Must be called with mu held.
+func (c *ConsumerConnection) delayedOffsets() []uint64 {
+	var offsets []uint64
+	for offset := range c.delayed {
+		if offset < c.committed {
+			offsets = append(offsets, offset)
+		}
+	}
+	slices.Sort(offsets)
+	return offsets
+}
+
+// Store the position of a durable subscription or group. Must be called with
+// mu held.
+func (c *ConsumerConnection) saveState(db *badger.DB, topic string) error {
+	return saveSubscription(db, topic, c.Subscription, &SubscriptionState{
+		NextOffset: c.committed,
+		Delayed:    c.delayedOffsets(),
+		Group:      c.group,
+	})
+}
+
+// Read back the scheduled messages a durable subscription or group moved past
+// without acknowledging them. The ones deleted since are skipped.
+func (c *ConsumerConnection) restoreDelayed(db *badger.DB, topic string, offsets []uint64, schedule *Schedule) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, offset := range offsets {
+		messages, err := readMessages(db, topic, offset, offset+1)
+		if err != nil {
+			return err
+		}
+		for _, message := range messages {
+			c.delayed[message.Offset] = true
+			c.enqueue(message, schedule)
+		}
+	}
+	return nil
+}
+
+// Add a message read from the topic to the pending messages, or keep it aside
+// if it is not due yet. Must be called with mu held.
+func (c *ConsumerConnection) enqueue(message *HLCMsg, schedule *Schedule) {
+	if message.DeliverAt > 0 && schedule.Holds(message.Offset) {
+		c.held[message.Offset] = message
+		c.delayed[message.Offset] = true
+		return
+	}
+	c.PendingMessage.AddMessage(message)
+}
+
+// Move the held messages now due to the pending messages
+func (c *ConsumerConnection) releaseHeld(offsets []uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, offset := range offsets {
+		if message, held := c.held[offset]; held {
+			delete(c.held, offset)
+			c.PendingMessage.AddMessage(message)
+		}
+	}
+}
+
+// Add the message at the given offset to the pending messages if it is the
+// next one the consumer is waiting for. A lagging consumer, or one busy
+// reading the topic log, is only woken up to read the message from the log so
+// a publish never waits on a consumer.
+func (c *ConsumerConnection) offer(message *HLCMsg, schedule *Schedule) {
+	if !c.mu.TryLock() {
+		c.PendingMessage.Notify()
+		return
+	}
+	defer c.mu.Unlock()
+
+	if message.Offset != c.NextOffset || c.PendingMessage.Len() >= maxPendingMessages {
+		c.PendingMessage.Notify()
+		return
+	}
+	c.enqueue(message, schedule)
+	c.NextOffset++
 }
 
 type TopicPool struct {
-	Topic       string                         // The topic this pool is for
-	Connections map[string]*ConsumerConnection // Map of consumer ID to connection
-	Mutex       sync.RWMutex                   // Mutex for thread-safe access
-	MessageLog  *MessageQueue                  // Persisten Log of all message
+	Topic            string                         // The topic this pool is for
+	Connections      map[string]*ConsumerConnection // Map of consumer ID to connection, a consumer group has a single shared one
+	Groups           map[string]*ConsumerGroup      // Map of group name to the group members
+	Mutex            sync.RWMutex                   // Mutex for thread-safe access
+	MessageLog       *TopicLog                      // Most recent messages of the topic, the rest is on disk
+	NextOffset       uint64                         // Offset given to the next message stored
+	FirstOffset      uint64                         // Messages before it were deleted by the retention policy
+	StoredBytes      int64                          // Size of the stored messages, deletions are counted by CountStoredBytes
+	Config           TopicConfig                    // Settings of the topic
+	Schedule         *Schedule                      // Messages not due yet
+	attempts         map[string]*deliveryAttempts   // Map of durable subscription or group name to its delivery attempts
+	expiry           expiryStats
+	retentionDeleted atomic.Uint64
+	compacted        atomic.Uint64
+	Clock            *HLC // Clock used to stamp the messages of the topic
+	deleted          bool // Dropped with its namespace, nothing can be written to it
 }
 
 type TopicManager struct {
-	Pools map[string]*TopicPool // Map of topic name to topic pool
-	Mutex sync.RWMutex          // Mutex for thread-safe access
+	Pools       map[string]*TopicPool // Map of topic name to topic pool
+	Mutex       sync.RWMutex          // Mutex for thread-safe access
+	HotTailSize int                   // Number of recent messages per topic kept in memory
+	redriveMu   sync.Mutex            // One re-drive at a time
+	deleting    map[string]bool       // Namespaces whose keys are being dropped
+
+	namespaceMu    sync.Mutex
+	namespaceBytes map[string]int64 // Map of namespace to the stored bytes of its topics
+
+	MaxStoredBytes          int64 // Publishes taking a topic over this many stored bytes are refused, 0 for no limit
+	MaxNamespaceStoredBytes int64 // Publishes taking the topics of a namespace over this many stored bytes are refused, 0 for no limit
+	MaxSubscriptions        int   // Subscriptions a topic accepts at once, 0 for no limit
 }
 
 func NewTopicManager(logger *LoggerType) *TopicManager {
 	return &TopicManager{
-		Pools: make(map[string]*TopicPool),
+		Pools:          make(map[string]*TopicPool),
+		HotTailSize:    DefaultHotTailSize,
+		deleting:       make(map[string]bool),
+		namespaceBytes: make(map[string]int64),
 	}
 }
 
@@ -38,6 +199,32 @@ func (tm *TopicManager) GetOrCreatePool(topic string) *TopicPool {
 	tm.Mutex.Lock()
 	defer tm.Mutex.Unlock()
 
+	return tm.createPool(topic)
+}
+
+// Get the pool of a topic to write to it, created if needed, and return it
+// locked. Fails while the namespace of the topic is being deleted, so nothing
+// is written under the keys being dropped.
+func (tm *TopicManager) lockPool(topic string) (*TopicPool, error) {
+	tm.Mutex.Lock()
+	if namespace, _ := SplitTopic(topic); tm.deleting[namespace] {
+		tm.Mutex.Unlock()
+		return nil, ErrNamespaceDeleting
+	}
+	pool := tm.createPool(topic)
+	tm.Mutex.Unlock()
+
+	pool.Mutex.Lock()
+	// Deleted while waiting for the lock
+	if pool.deleted {
+		pool.Mutex.Unlock()
+		return nil, ErrNamespaceDeleting
+	}
+	return pool, nil
+}
+
+// Must be called with the mutex held
+func (tm *TopicManager) createPool(topic string) *TopicPool {
 	if p, exists := tm.Pools[topic]; exists {
 		return p
 	}
@@ -45,100 +232,209 @@ func (tm *TopicManager) GetOrCreatePool(topic string) *TopicPool {
 	pool := &TopicPool{
 		Topic:       topic,
 		Connections: make(map[string]*ConsumerConnection),
-		MessageLog:  NewMessageQueue(),
+		Groups:      make(map[string]*ConsumerGroup),
+		attempts:    make(map[string]*deliveryAttempts),
+		MessageLog:  NewTopicLog(tm.HotTailSize, 0),
+		Clock:       NewHLC(),
+		Schedule:    NewSchedule(),
 	}
 	tm.Pools[topic] = pool
 	return pool
 }
 
-// Save new message to disk
-func (tm *TopicManager) SavePool(db *badger.DB, logger *LoggerType, topic string) {
-	pool := tm.GetOrCreatePool(topic)
+// Get the pool of an existing topic
+func (tm *TopicManager) GetPool(topic string) (*TopicPool, bool) {
+	tm.Mutex.RLock()
+	defer tm.Mutex.RUnlock()
 
-	err := db.Update(func(txn *badger.Txn) error {
-		enc, err := EncodeQueue(pool.MessageLog)
-		if err != nil {
-			return err
-		}
-		txn.Set([]byte(topic), enc)
-		return nil
-	})
+	pool, exists := tm.Pools[topic]
+	return pool, exists
+}
 
-	if err != nil {
-		logger.Error(err.Error())
-		return
+// Get a consumer connection of an existing topic
+func (tm *TopicManager) GetConnection(topic, consumerId string) (*TopicPool, *ConsumerConnection, bool) {
+	pool, exists := tm.GetPool(topic)
+	if !exists {
+		return nil, nil, false
 	}
+
+	pool.Mutex.RLock()
+	defer pool.Mutex.RUnlock()
+
+	c, exists := pool.Connections[consumerId]
+	return pool, c, exists
 }
 
 // Load all saved pools on startup
 func (tm *TopicManager) LoadPools(db *badger.DB, logger *LoggerType) {
+	if err := migrateLegacyTopics(db, logger); err != nil {
+		logger.Error(err.Error())
+		return
+	}
+
 	err := db.View(func(txn *badger.Txn) error {
+		prefix := []byte(topicKeyPrefix)
 		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
 		it := txn.NewIterator(opts)
 		defer it.Close()
-		for it.Rewind(); it.Valid(); it.Next() {
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
 			item := it.Item()
-			k := item.Key()
+			topic := string(item.Key()[len(prefix):])
+			var meta TopicMeta
 			err := item.Value(func(v []byte) error {
-				pool := tm.GetOrCreatePool(string(k))
-				q, err := DecodeQueue(v)
-				pool.MessageLog = q
-				if err != nil {
-					return err
-				}
+				return decodeGob(v, &meta)
+			})
+			if err != nil {
+				return err
+			}
+
+			// Only the hot tail is loaded in memory
+			pool := tm.GetOrCreatePool(topic)
+			pool.NextOffset = meta.NextOffset
+			first := uint64(0)
+			if meta.NextOffset > uint64(tm.HotTailSize) {
+				first = meta.NextOffset - uint64(tm.HotTailSize)
+			}
+			pool.MessageLog = NewTopicLog(tm.HotTailSize, first)
+			err = iterateMessages(txn, topic, first, meta.NextOffset, func(offset uint64, message *HLCMsg) error {
+				pool.Clock.Update(message.Physical, message.Logical)
+				pool.MessageLog.Append(message)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			// The topic starts at its oldest message left by the retention policy
+			pool.FirstOffset = meta.NextOffset
+			err = iterateMessageSizes(txn, topic, 0, meta.NextOffset, func(offset uint64, valueSize int64) error {
+				pool.FirstOffset = min(pool.FirstOffset, offset)
+				pool.StoredBytes += valueSize
 				return nil
 			})
 			if err != nil {
 				return err
 			}
+			namespace, _ := SplitTopic(topic)
+			tm.addNamespaceBytes(namespace, pool.StoredBytes)
 		}
 
-		return nil
+		if err := tm.loadTopicConfigs(txn); err != nil {
+			return err
+		}
+		return tm.loadSchedules(txn)
 	})
 
 	if err != nil {
 		logger.Error(err.Error())
 		return
 	}
+	tm.Mutex.RLock()
+	for _, pool := range tm.Pools {
+		tm.armSchedule(db, logger, pool)
+	}
+	tm.Mutex.RUnlock()
 	logger.Info("Load topic done")
 }
 
-func (tm *TopicManager) SubscribeConsumer(topic, consumerId string, conn net.Conn) {
-	pool := tm.GetOrCreatePool(topic)
-
-	pool.Mutex.Lock()
+// Subscribe a consumer to the messages published from now on
+func (tm *TopicManager) SubscribeConsumer(topic, consumerId string, conn net.Conn) error {
+	pool, err := tm.lockPool(topic)
+	if err != nil {
+		return err
+	}
 	defer pool.Mutex.Unlock()
 
-	pool.Connections[consumerId] = &ConsumerConnection{
-		ID:             consumerId,
-		Conn:           conn,
-		PendingMessage: NewMessageQueue(),
+	if err := tm.checkSubscriptions(pool); err != nil {
+		return err
 	}
-
+	pool.Connections[consumerId] = newConsumerConnection(consumerId, conn, pool.NextOffset)
+	return nil
 }
 
-func (tm *TopicManager) PublishMessage(db *badger.DB, logger *LoggerType, topic string, message *HLCMsg) {
-	tm.Mutex.RLock()
-	pool, exists := tm.Pools[topic]
-	tm.Mutex.RUnlock()
-	tm.SavePool(db, logger, topic)
+// Commit a message to the topic log, the message is stamped with the topic
+// clock and only forwarded to consumers once it is stored on disk
+func (tm *TopicManager) PublishMessage(db *badger.DB, logger *LoggerType, topic string, message *HLCMsg) error {
+	return tm.PublishMessages(db, logger, topic, []*HLCMsg{message})
+}
 
-	if !exists {
-		logger.Info("No subscribers for topic %s", topic)
-		return
+// Commit a batch of messages to the topic log. The batch is stored in a single
+// write, either every message is stored or none is.
+//
+// Ordering guarantee: commits of a topic are serialized by the pool mutex,
+// each message gets the next offset and a topic clock timestamp greater than
+// every message committed before it, and is handed to the consumers before
+// the next commit starts. Every consumer of a topic therefore receives its
+// messages in commit order, whatever the number of concurrent producers.
+// Messages from a single producer connection are committed in the order they
+// were sent.
+func (tm *TopicManager) PublishMessages(db *badger.DB, logger *LoggerType, topic string, messages []*HLCMsg) error {
+	pool, err := tm.lockPool(topic)
+	if err != nil {
+		return err
 	}
+	defer pool.Mutex.Unlock()
 
-	pool.Mutex.RLock()
-	defer pool.Mutex.RUnlock()
+	if pool.Config.Compacted {
+		for _, message := range messages {
+			if message.Key == "" {
+				return ErrMissingKey
+			}
+		}
+	}
+	for _, message := range messages {
+		message.Physical, message.Logical = pool.Clock.Receive(message.Physical, message.Logical)
+	}
+	scheduleMessages(messages)
+	expireMessages(messages, pool.Config.DefaultTTL)
+	namespace, _ := SplitTopic(topic)
+	var reserved int64
+	size, err := storeMessages(db, topic, pool.NextOffset, messages, func(size int64) error {
+		if err := tm.checkStoredBytes(pool, size); err != nil {
+			return err
+		}
+		if err := tm.reserveNamespaceBytes(namespace, size); err != nil {
+			return err
+		}
+		reserved = size
+		return nil
+	})
+	if err != nil {
+		tm.addNamespaceBytes(namespace, -reserved)
+	}
+	if errors.Is(err, ErrQuotaExceeded) {
+		return err
+	}
+	if err != nil {
+		logger.Error("Error saving %d messages to topic %s: %s", len(messages), topic, err)
+		return err
+	}
+	pool.StoredBytes += size
+	scheduled := false
+	for _, message := range messages {
+		if message.DeliverAt > 0 {
+			pool.Schedule.add(message.Offset, message.DeliverAt)
+			scheduled = true
+		}
+	}
+	if scheduled {
+		tm.armSchedule(db, logger, pool)
+	}
+	pool.NextOffset += uint64(len(messages))
+	pool.MessageLog.Append(messages...)
 
-	for _, conn := range pool.Connections {
-		go func(c *ConsumerConnection) {
-			// c.Mutex.Lock()
-			// defer c.Mutex.Unlock()
-			c.PendingMessage.AddMessage(message)
+	if len(pool.Connections) == 0 {
+		logger.Info("No subscribers for topic %s", topic)
+		return nil
+	}
 
-		}(conn)
+	for _, message := range messages {
+		for _, conn := range pool.Connections {
+			conn.offer(message, pool.Schedule)
+		}
 	}
+	return nil
 }
 
 func (tm *TopicManager) UnsubscribeConsumer(topic, consumerId string) {
@@ -197,33 +493,95 @@ func (tm *TopicManager) UnsubscribeConsumer(topic, consumerId string) {
 // 	}
 // }
 
+// Log an error of a connection to a client. The errors can come wrapped, by
+// TLS for one, so they are unwrapped instead of type asserted.
 func HandleNetworkErrorByPeer(logger *LoggerType, err error) {
-	if opErr, ok := err.(*net.OpError); ok && opErr.Err.Error() == "connection reset by peer" {
+	var opErr *net.OpError
+	switch {
+	case err == nil:
+	case errors.Is(err, syscall.ECONNRESET):
 		logger.Info("Connection reset by peer detected")
-		return
-	} else if err.Error() == "EOF" {
+	case errors.Is(err, io.EOF), errors.Is(err, syscall.EPIPE), errors.Is(err, net.ErrClosed):
 		logger.Info("Connection closed by client")
-		return
-	} else if sysErr, ok := opErr.Err.(*os.SyscallError); ok && sysErr.Err.Error() == "broken pipe" {
-		logger.Info("Connection closed by client")
-		return
+	case errors.As(err, &opErr):
+		logger.Error("Network error on %s: %s", opErr.Op, err)
 	}
-
-	return
 }
 
-func (tm *TopicManager) ReplayMessageLog(topic, consumerId string) {
+// Number of messages of the topic stored after the given offset
+func (tm *TopicManager) Lag(topic string, offset uint64) uint64 {
 	tm.Mutex.RLock()
 	pool, exists := tm.Pools[topic]
 	tm.Mutex.RUnlock()
 
+	if !exists {
+		return 0
+	}
+
+	pool.Mutex.RLock()
+	defer pool.Mutex.RUnlock()
+
+	if pool.NextOffset <= offset {
+		return 0
+	}
+	return pool.NextOffset - offset - 1
+}
+
+// Replay the topic from its oldest message left. Nothing is copied here, the
+// consumer reads the log from disk as it goes through its pending messages.
+func (tm *TopicManager) ReplayMessageLog(topic, consumerId string) {
+	pool, c, exists := tm.GetConnection(topic, consumerId)
 	if !exists {
 		return
 	}
 
-	pool.Mutex.Lock()
-	defer pool.Mutex.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.PendingMessage.Clear()
+	clear(c.held)
+	clear(c.delayed)
+	pool.Mutex.RLock()
+	c.NextOffset = pool.FirstOffset
+	pool.Mutex.RUnlock()
+}
+
+// Refill the pending messages of a consumer that went through them and is
+// behind the end of the topic, from the hot tail or from disk. Return the
+// number of offsets read, some of them may hold no message any more.
+func (tm *TopicManager) FillPending(db *badger.DB, topic, consumerId string) (int, error) {
+	pool, c, exists := tm.GetConnection(topic, consumerId)
+	if !exists {
+		return 0, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	copyH := pool.MessageLog.heap.DeepCopy()
-	pool.Connections[consumerId].PendingMessage.heap = (*MessageHeap)(&copyH)
+	if c.PendingMessage.Len() > 0 {
+		return 0, nil
+	}
+
+	pool.Mutex.RLock()
+	from := c.NextOffset
+	to := min(pool.NextOffset, from+maxPendingMessages)
+	messages, inMemory := pool.MessageLog.Range(from, to)
+	pool.Mutex.RUnlock()
+	if from >= to {
+		return 0, nil
+	}
+
+	if !inMemory {
+		var err error
+		messages, err = readMessages(db, topic, from, to)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for _, message := range messages {
+		c.enqueue(message, pool.Schedule)
+	}
+	c.NextOffset = to
+	return int(to - from), nil
 }
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestHandleNetworkErrorByPeer(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"nil", nil, ""},
+		{"eof", io.EOF, "closed by client"},
+		{"reset", &net.OpError{Op: "read", Err: &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}}, "reset by peer"},
+		{"broken pipe", &net.OpError{Op: "write", Err: &os.SyscallError{Syscall: "write", Err: syscall.EPIPE}}, "closed by client"},
+		{"closed", &net.OpError{Op: "write", Err: net.ErrClosed}, "closed by client"},
+		// As TLS returns it, a wrapped write error
+		{"wrapped broken pipe", fmt.Errorf("tls: %w", &net.OpError{Op: "write", Err: &os.SyscallError{Syscall: "write", Err: syscall.EPIPE}}), "closed by client"},
+		{"op error without cause", &net.OpError{Op: "dial"}, "Network error on dial"},
+		{"not a network error", errors.New("tls: use of closed connection"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			logger := &LoggerType{
+				InfoLogger:  log.New(&out, "", 0),
+				ErrorLogger: log.New(&out, "", 0),
+			}
+			HandleNetworkErrorByPeer(logger, tt.err)
+			if tt.want == "" && out.Len() > 0 || !strings.Contains(out.String(), tt.want) {
+				t.Fatalf("logged %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"strconv"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Headers set on a message moved to a dead letter topic
+const (
+	HeaderOriginalTopic  = "x-original-topic"
+	HeaderOriginalOffset = "x-original-offset"
+	HeaderFailureReason  = "x-failure-reason"
+	HeaderAttempts       = "x-delivery-attempts"
+)
+
+// Durable subscription of a dead letter topic holding how far it was re-driven
+const redriveSubscription = "$redrive"
+
+// Messages re-driven per transaction
+const redriveBatchSize = 1000
+
+// Move a message in flight to the dead letter topic of its topic, then
+// acknowledge it so the consumer moves past it
+func (tm *TopicManager) DeadLetter(db *badger.DB, logger *LoggerType, topic, consumerId string, message *HLCMsg, attempts int, reason string) error {
+	config, err := tm.TopicConfig(topic)
+	if err != nil {
+		return err
+	}
+	deadLetterTopic := config.DeadLetterTopicFor(topic)
+
+	dead := message.DeepCopy()
+	dead.Attempt = 0
+	dead.DeliverAt = 0
+	dead.ExpiresAt = 0
+	if dead.Headers == nil {
+		dead.Headers = make(map[string]string)
+	}
+	// The name within the namespace, a re-drive can not leave the namespace
+	_, name := SplitTopic(topic)
+	dead.Headers[HeaderOriginalTopic] = name
+	dead.Headers[HeaderOriginalOffset] = strconv.FormatUint(message.Offset, 10)
+	dead.Headers[HeaderFailureReason] = reason
+	dead.Headers[HeaderAttempts] = strconv.Itoa(attempts)
+	if err := tm.PublishMessages(db, logger, deadLetterTopic, []*HLCMsg{dead}); err != nil {
+		return err
+	}
+	logger.Info("Message ID %s offset %d of topic %s moved to %s after %d attempts: %s", message.ID, message.Offset, topic, deadLetterTopic, attempts, reason)
+	return tm.Acknowledge(db, topic, consumerId, message.Offset)
+}
+
+// Publish the messages of a dead letter topic back to the topics they came
+// from, starting after the last message re-driven. Return the number of
+// messages re-driven. Messages are published in runs going to the same topic,
+// allow is asked for each run before it is published and a re-drive stops at
+// the first run it refuses. The position is stored after each run, a re-drive
+// failing halfway resumes after the last run published.
+func (tm *TopicManager) Redrive(db *badger.DB, logger *LoggerType, deadLetterTopic string, allow func(topic string, messages []*HLCMsg) error) (int, error) {
+	pool, exists := tm.GetPool(deadLetterTopic)
+	if !exists {
+		return 0, ErrUnknownTopic
+	}
+
+	tm.redriveMu.Lock()
+	defer tm.redriveMu.Unlock()
+
+	state, err := loadSubscription(db, deadLetterTopic, redriveSubscription)
+	if err == ErrUnknownSubscription {
+		state, err = &SubscriptionState{}, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	pool.Mutex.RLock()
+	end := pool.NextOffset
+	pool.Mutex.RUnlock()
+
+	count := 0
+	var run []*HLCMsg
+	var runTopic string
+	// Publish the current run and store next as the position
+	publish := func(next uint64) error {
+		if len(run) > 0 {
+			if allow != nil {
+				if err := allow(runTopic, run); err != nil {
+					return err
+				}
+			}
+			if err := tm.PublishMessages(db, logger, runTopic, run); err != nil {
+				return err
+			}
+			count += len(run)
+			run = nil
+		}
+		state.NextOffset = next
+		return saveSubscription(db, deadLetterTopic, redriveSubscription, state)
+	}
+
+	namespace, _ := SplitTopic(deadLetterTopic)
+	for from := state.NextOffset; from < end; from = state.NextOffset {
+		to := min(from+redriveBatchSize, end)
+		messages, err := readMessages(db, deadLetterTopic, from, to)
+		if err != nil {
+			return count, err
+		}
+
+		for _, message := range messages {
+			name := message.Headers[HeaderOriginalTopic]
+			if ValidateTopic(name) != nil {
+				logger.Error("Message ID %s offset %d of topic %s has no valid original topic, not re-driven", message.ID, message.Offset, deadLetterTopic)
+				continue
+			}
+			topic := QualifiedTopic(namespace, name)
+			if len(run) > 0 && topic != runTopic {
+				if err := publish(message.Offset); err != nil {
+					return count, err
+				}
+			}
+			for _, header := range []string{HeaderOriginalTopic, HeaderOriginalOffset, HeaderFailureReason, HeaderAttempts} {
+				delete(message.Headers, header)
+			}
+			runTopic = topic
+			run = append(run, message)
+		}
+		if err := publish(to); err != nil {
+			return count, err
+		}
+	}
+	logger.Info("Re-drove %d messages of topic %s", count, deadLetterTopic)
+	return count, nil
+}
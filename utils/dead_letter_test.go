@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// A re-drive stopping halfway resumes after the last run of messages it
+// published, none of them is published twice
+func TestRedriveResumesAfterLastRun(t *testing.T) {
+	db := openTestDB(t)
+	logger := testLogger()
+	tm := NewTopicManager(logger)
+
+	var dead []*HLCMsg
+	for i, topic := range []string{"orders", "orders", "billing", "orders"} {
+		dead = append(dead, &HLCMsg{
+			Body:    []byte(fmt.Sprintf("dead %d", i)),
+			Headers: map[string]string{HeaderOriginalTopic: topic},
+		})
+	}
+	if err := tm.PublishMessages(db, logger, "orders.DLQ", dead); err != nil {
+		t.Fatal(err)
+	}
+
+	refused := errors.New("refused")
+	n, err := tm.Redrive(db, logger, "orders.DLQ", func(topic string, messages []*HLCMsg) error {
+		if topic == "billing" {
+			return refused
+		}
+		return nil
+	})
+	if err != refused || n != 2 {
+		t.Fatalf("re-drove %d messages with error %v, want 2 and the refusal", n, err)
+	}
+
+	n, err = tm.Redrive(db, logger, "orders.DLQ", nil)
+	if err != nil || n != 2 {
+		t.Fatalf("resumed re-drive of %d messages with error %v, want 2", n, err)
+	}
+	stats, err := tm.TopicStats("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats[0].NextOffset != 3 {
+		t.Fatalf("%d messages re-driven to orders, want 3", stats[0].NextOffset)
+	}
+}
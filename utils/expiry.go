@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Messages with a time to live are indexed by expiry time
+//
+//	exp/<topic>\x00<expiry><offset> -> empty, expiry is unix nanoseconds and both are 8 bytes big endian
+//
+// so the purge only walks the messages already expired.
+const expiryKeyPrefix = "exp/"
+
+// Messages deleted per purge transaction
+const purgeBatchSize = 1000
+
+func expiryPrefix(topic string) []byte {
+	return []byte(expiryKeyPrefix + topic + "\x00")
+}
+
+func expiryKey(topic string, expiresAt int64, offset uint64) []byte {
+	key := binary.BigEndian.AppendUint64(expiryPrefix(topic), uint64(expiresAt))
+	return binary.BigEndian.AppendUint64(key, offset)
+}
+
+// Expiry counters of a topic
+type expiryStats struct {
+	dropped atomic.Uint64 // Expired messages skipped instead of being sent to a consumer
+	purged  atomic.Uint64 // Expired messages deleted from the store
+}
+
+// Whether the message expired at the given time
+func (m *HLCMsg) Expired(now time.Time) bool {
+	return m.ExpiresAt > 0 && m.ExpiresAt <= now.UnixNano()
+}
+
+// Set the expiry time of the messages of a batch from their time to live, or
+// from the default of the topic
+func expireMessages(messages []*HLCMsg, defaultTTL time.Duration) {
+	now := time.Now()
+	for _, message := range messages {
+		ttl := message.TTL
+		if ttl <= 0 {
+			ttl = defaultTTL
+		}
+		if ttl > 0 && message.ExpiresAt == 0 {
+			message.ExpiresAt = now.Add(ttl).UnixNano()
+		}
+		message.TTL = 0
+	}
+}
+
+// Skip an expired message taken from the pending messages of a consumer, the
+// consumer position moves past it
+func (tm *TopicManager) DropExpired(db *badger.DB, logger *LoggerType, topic, consumerId string, message *HLCMsg) error {
+	pool, exists := tm.GetPool(topic)
+	if !exists {
+		return nil
+	}
+	pool.expiry.dropped.Add(1)
+	logger.Info("Message ID %s offset %d of topic %s expired, not delivered to consumer %s", message.ID, message.Offset, topic, consumerId)
+	return tm.Acknowledge(db, topic, consumerId, message.Offset)
+}
+
+// Delete the expired messages of every topic from the store
+func (tm *TopicManager) PurgeExpired(db *badger.DB, logger *LoggerType) error {
+	tm.Mutex.RLock()
+	pools := make([]*TopicPool, 0, len(tm.Pools))
+	for _, pool := range tm.Pools {
+		pools = append(pools, pool)
+	}
+	tm.Mutex.RUnlock()
+
+	now := uint64(time.Now().UnixNano())
+	for _, pool := range pools {
+		purged := 0
+		for {
+			n, err := purgeExpiredBatch(db, pool.Topic, now)
+			if err != nil {
+				return err
+			}
+			purged += n
+			if n < purgeBatchSize {
+				break
+			}
+		}
+		if purged > 0 {
+			pool.expiry.purged.Add(uint64(purged))
+			logger.Info("Purged %d expired messages of topic %s, %d expired so far", purged, pool.Topic, pool.expiry.purged.Load())
+		}
+	}
+	return nil
+}
+
+// Delete up to purgeBatchSize messages of a topic expired at now, return the
+// number of messages deleted
+func purgeExpiredBatch(db *badger.DB, topic string, now uint64) (int, error) {
+	n := 0
+	err := db.Update(func(txn *badger.Txn) error {
+		prefix := expiryPrefix(topic)
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+
+		var keys [][]byte
+		for it.Seek(prefix); it.ValidForPrefix(prefix) && len(keys) < purgeBatchSize; it.Next() {
+			key := it.Item().KeyCopy(nil)
+			if binary.BigEndian.Uint64(key[len(prefix):]) > now {
+				break
+			}
+			keys = append(keys, key)
+		}
+		it.Close()
+
+		for _, key := range keys {
+			offset := messageKeyOffset(key)
+			if err := txn.Delete(messageKey(topic, offset)); err != nil {
+				return err
+			}
+			// The message may have been scheduled as well
+			if err := txn.Delete(scheduleKey(topic, offset)); err != nil {
+				return err
+			}
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+		n = len(keys)
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpireMessages(t *testing.T) {
+	const defaultTTL = time.Minute
+	set := time.Now().Add(time.Hour).UnixNano()
+	messages := []*HLCMsg{
+		{},
+		{TTL: time.Second},
+		{ExpiresAt: set},
+	}
+	before := time.Now()
+	expireMessages(messages, defaultTTL)
+	after := time.Now()
+
+	for i, ttl := range []time.Duration{defaultTTL, time.Second} {
+		expiresAt := time.Unix(0, messages[i].ExpiresAt)
+		if expiresAt.Before(before.Add(ttl)) || expiresAt.After(after.Add(ttl)) || messages[i].TTL != 0 {
+			t.Errorf("message %d expires at %s with TTL %s, want in %s", i, expiresAt, messages[i].TTL, ttl)
+		}
+	}
+	if messages[2].ExpiresAt != set {
+		t.Errorf("expiry time set by the producer changed to %d", messages[2].ExpiresAt)
+	}
+	if messages[0].Expired(before) || !messages[0].Expired(after.Add(defaultTTL)) {
+		t.Error("message expired at the wrong time")
+	}
+}
+
+// The purge deletes the expired messages with their index entries, and only
+// them
+func TestPurgeExpired(t *testing.T) {
+	db := openTestDB(t)
+	logger := testLogger()
+	tm := NewTopicManager(logger)
+	past := time.Now().Add(-time.Minute).UnixNano()
+	later := time.Now().Add(time.Hour).UnixNano()
+	messages := []*HLCMsg{
+		{Body: []byte("expired"), ExpiresAt: past},
+		{Body: []byte("expired and scheduled"), ExpiresAt: past, DeliverAt: later},
+		{Body: []byte("alive"), ExpiresAt: later},
+		{Body: []byte("forever")},
+	}
+	if _, err := storeMessages(db, "orders", 0, messages, nil); err != nil {
+		t.Fatal(err)
+	}
+	tm.GetOrCreatePool("orders")
+
+	if err := tm.PurgeExpired(db, logger); err != nil {
+		t.Fatal(err)
+	}
+	for prefix, want := range map[string]int{messageKeyPrefix: 2, expiryKeyPrefix: 1, scheduleKeyPrefix: 0} {
+		if n := countKeys(t, db, prefix); n != want {
+			t.Errorf("%d keys left under %s, want %d", n, prefix, want)
+		}
+	}
+	stats, err := tm.TopicStats("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats[0].ExpiredPurged != 2 {
+		t.Fatalf("purged %d expired messages, want 2", stats[0].ExpiredPurged)
+	}
+}
@@ -0,0 +1,328 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Every message exchanged between broker and clients is wrapped in a frame:
+//
+//	| length (4 bytes, big endian) | version (1 byte) | type (1 byte) | payload (length bytes) |
+//
+// The length only counts the payload, so a frame is never bigger than
+// FrameHeaderSize + the configured max frame size.
+const (
+	FrameVersion        uint8  = 1
+	FrameHeaderSize            = 6
+	DefaultMaxFrameSize uint32 = 16 * 1024 * 1024 // 16 Mb
+)
+
+type FrameType uint8
+
+const (
+	FrameHandshake       FrameType = iota + 1 // Client -> broker, first frame of a connection
+	FramePublish                              // Producer -> broker, a message to publish
+	FrameMessage                              // Broker -> consumer, a message to deliver
+	FrameAck                                  // Consumer -> broker, message processed, payload is an Ack
+	FrameError                                // Either way, payload is an ErrorMessage
+	FramePublishAck                           // Broker -> producer, payload is a PublishAck
+	FramePublishBatch                         // Producer -> broker, payload is a PublishBatch
+	FramePublishBatchAck                      // Broker -> producer, payload is a PublishBatchAck
+	FrameAdmin                                // Producer -> broker, payload is an AdminRequest
+	FrameAdminResponse                        // Broker -> producer, payload is an AdminResponse
+	FrameSeek                                 // Consumer -> broker, payload is a StartPosition
+	FrameSeekAck                              // Broker -> consumer, payload is a SeekAck
+	FrameFetch                                // Pull consumer -> broker, payload is a FetchRequest
+	FrameFetchResponse                        // Broker -> pull consumer, payload is a FetchResponse
+	FrameCredit                               // Consumer -> broker, payload is the new Credit of the consumer
+	FrameNack                                 // Consumer -> broker, message failed, payload is a Nack
+	FrameExportChunk                          // Broker -> producer, raw bytes of an export, the export ends with an admin response frame
+)
+
+var (
+	ErrFrameTooLarge      = errors.New("frame exceeds max frame size")
+	ErrFrameTruncated     = errors.New("frame truncated")
+	ErrUnsupportedVersion = errors.New("unsupported frame version")
+	ErrUnexpectedFrame    = errors.New("unexpected frame type")
+)
+
+// Error codes carried by an error frame
+const (
+	ErrCodeFrameTooLarge   = "frame_too_large"
+	ErrCodeFrameTruncated  = "frame_truncated"
+	ErrCodeBadRequest      = "bad_request"
+	ErrCodeUnknownTopic    = "unknown_topic"
+	ErrCodeStorage         = "storage_error"
+	ErrCodeInUse           = "in_use"
+	ErrCodeNotFound        = "not_found"
+	ErrCodePositionDeleted = "position_deleted"
+	ErrCodeUnauthenticated = "unauthenticated"
+	ErrCodeForbidden       = "forbidden"
+	ErrCodeQuotaExceeded   = "quota_exceeded"
+)
+
+// Admin commands, sent by producers on their session
+const (
+	AdminListSubscriptions  = "list_subscriptions"
+	AdminResetSubscription  = "reset_subscription"
+	AdminDeleteSubscription = "delete_subscription"
+	AdminGetTopicConfig     = "get_topic_config"
+	AdminSetTopicConfig     = "set_topic_config"
+	AdminRedrive            = "redrive"
+	AdminTopicStats         = "topic_stats"
+	AdminListNamespaces     = "list_namespaces"
+	AdminExportNamespace    = "export_namespace"
+	AdminDeleteNamespace    = "delete_namespace"
+)
+
+type Frame struct {
+	Version uint8
+	Type    FrameType
+	Payload []byte
+}
+
+// Payload of a publish ack frame, sent once the message is stored
+type PublishAck struct {
+	ID       string
+	Physical int64
+	Logical  int64
+	Offset   uint64
+}
+
+// Payload of a publish batch frame, every message of the batch goes to the same topic
+type PublishBatch struct {
+	Topic    string
+	Messages []*HLCMsg
+}
+
+// Payload of a publish batch ack frame, one ack per message in batch order
+type PublishBatchAck struct {
+	Acks []PublishAck
+}
+
+// Payload of an admin frame
+type AdminRequest struct {
+	Command      string
+	Topic        string
+	Subscription string
+	Offset       uint64
+	Config       *TopicConfig
+	Namespace    string // Target of the namespace commands
+}
+
+// Payload of an admin response frame
+type AdminResponse struct {
+	Subscriptions []SubscriptionInfo
+	Config        *TopicConfig
+	Count         int // Number of messages re-driven
+	Stats         []TopicStats
+	Namespaces    []NamespaceInfo
+}
+
+// Payload of an ack frame. Acks can come in any order, an ack frame without
+// payload acknowledges the oldest message in flight.
+type Ack struct {
+	Offset uint64
+}
+
+// Payload of a nack frame. The message is sent again after Delay, or after a
+// backoff growing with its delivery attempts if Delay is zero. A rejected
+// message is not sent again, it goes to the dead letter topic if the topic has
+// one.
+type Nack struct {
+	Offset uint64
+	Delay  time.Duration
+	Reject bool
+	Reason string
+}
+
+// Window of a pushing consumer, the broker keeps at most Messages messages and
+// Bytes of content in flight without an ack. A zero field means one message,
+// or no limit on the content size, but one message is always let through.
+type Credit struct {
+	Messages int
+	Bytes    int
+}
+
+// Payload of a seek ack frame, messages after it are read from the new position
+type SeekAck struct {
+	Offset uint64
+}
+
+// Payload of a fetch frame. The broker answers with up to Max messages and
+// MaxBytes of content, at least one message if any is available. With Wait set
+// the broker holds the request until a message arrives or Wait is up. The
+// response fits in MaxFrameSize, the frame size the consumer reads,
+// DefaultMaxFrameSize if zero.
+type FetchRequest struct {
+	Max          int
+	MaxBytes     int
+	Wait         time.Duration
+	MaxFrameSize uint32
+}
+
+// Payload of a fetch response frame, possibly empty
+type FetchResponse struct {
+	Messages []*HLCMsg
+}
+
+// Payload of an error frame
+type ErrorMessage struct {
+	Code    string
+	Message string
+}
+
+func (e *ErrorMessage) Error() string {
+	return fmt.Sprintf("broker error %s: %s", e.Code, e.Message)
+}
+
+// Write a single frame, header and payload go out in one write so concurrent
+// writers on the same connection can not interleave
+func WriteFrame(w io.Writer, t FrameType, payload []byte) error {
+	buf := make([]byte, FrameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	buf[4] = FrameVersion
+	buf[5] = byte(t)
+	copy(buf[FrameHeaderSize:], payload)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// Writer cutting what is written to it into frames of type t with payloads of
+// up to size bytes, for data that does not fit in one frame. Flush writes the
+// last frame.
+type FrameWriter struct {
+	w   io.Writer
+	t   FrameType
+	buf []byte
+}
+
+func NewFrameWriter(w io.Writer, t FrameType, size int) *FrameWriter {
+	return &FrameWriter{w: w, t: t, buf: make([]byte, 0, size)}
+}
+
+func (fw *FrameWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(fw.buf[len(fw.buf):cap(fw.buf)], p)
+		fw.buf = fw.buf[:len(fw.buf)+n]
+		p = p[n:]
+		if len(fw.buf) == cap(fw.buf) {
+			if err := fw.Flush(); err != nil {
+				return written, err
+			}
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Write what is buffered as a frame, if anything
+func (fw *FrameWriter) Flush() error {
+	if len(fw.buf) == 0 {
+		return nil
+	}
+	err := WriteFrame(fw.w, fw.t, fw.buf)
+	fw.buf = fw.buf[:0]
+	return err
+}
+
+// Read the next frame. io.EOF is returned as is when the peer closed the
+// connection between two frames. The payload of a frame over maxSize is not
+// read, the reader is left in the middle of the frame and the connection must
+// be closed after ErrFrameTooLarge.
+func ReadFrame(r io.Reader, maxSize uint32) (*Frame, error) {
+	header := make([]byte, FrameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("%w: incomplete header", ErrFrameTruncated)
+		}
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	frame := &Frame{
+		Version: header[4],
+		Type:    FrameType(header[5]),
+	}
+
+	if length > maxSize {
+		return nil, fmt.Errorf("%w: %d > %d bytes", ErrFrameTooLarge, length, maxSize)
+	}
+
+	frame.Payload = make([]byte, length)
+	if _, err := io.ReadFull(r, frame.Payload); err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return nil, fmt.Errorf("%w: payload of %d bytes", ErrFrameTruncated, length)
+		}
+		return nil, err
+	}
+
+	if frame.Version != FrameVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, frame.Version)
+	}
+
+	return frame, nil
+}
+
+// Encode a client message and write it as a frame of the given type
+func WriteMessageFrame(w io.Writer, t FrameType, message *ClientMessage) error {
+	msgEncode, err := MessageEncode(message)
+	if err != nil {
+		return err
+	}
+	return WriteFrame(w, t, msgEncode)
+}
+
+// Gob encode any payload struct and write it as a frame of the given type
+func WriteGobFrame(w io.Writer, t FrameType, v any) error {
+	payload, err := encodeGob(v)
+	if err != nil {
+		return err
+	}
+	return WriteFrame(w, t, payload)
+}
+
+// Size of the payload of a gob frame holding v
+func GobFrameSize(v any) (int, error) {
+	payload, err := encodeGob(v)
+	return len(payload), err
+}
+
+// Decode the gob payload of a frame into v
+func DecodeGobFrame(frame *Frame, v any) error {
+	return decodeGob(frame.Payload, v)
+}
+
+// Write an error frame to the peer
+func WriteErrorFrame(w io.Writer, code, format string, a ...any) error {
+	return WriteGobFrame(w, FrameError, &ErrorMessage{
+		Code:    code,
+		Message: fmt.Sprintf(format, a...),
+	})
+}
+
+// Decode the payload of an error frame
+func DecodeErrorFrame(frame *Frame) *ErrorMessage {
+	var e ErrorMessage
+	if err := DecodeGobFrame(frame, &e); err != nil {
+		return &ErrorMessage{Code: ErrCodeBadRequest, Message: "undecodable error frame"}
+	}
+	return &e
+}
+
+// Map a ReadFrame error to the error code reported back to the peer
+func FrameErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrFrameTooLarge):
+		return ErrCodeFrameTooLarge
+	case errors.Is(err, ErrFrameTruncated):
+		return ErrCodeFrameTruncated
+	default:
+		return ErrCodeBadRequest
+	}
+}
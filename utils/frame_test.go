@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// Raw frame with a header announcing length bytes of payload
+func rawFrame(length uint32, version uint8, t FrameType, payload string) []byte {
+	buf := binary.BigEndian.AppendUint32(nil, length)
+	buf = append(buf, version, byte(t))
+	return append(buf, payload...)
+}
+
+func TestReadFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		maxSize uint32
+		want    string
+		err     error
+	}{
+		{"frame", rawFrame(5, FrameVersion, FramePublish, "hello"), 16, "hello", nil},
+		{"empty payload", rawFrame(0, FrameVersion, FrameAck, ""), 16, "", nil},
+		{"payload at max size", rawFrame(4, FrameVersion, FramePublish, "four"), 4, "four", nil},
+		{"closed between frames", nil, 16, "", io.EOF},
+		{"truncated header", rawFrame(5, FrameVersion, FramePublish, "")[:3], 16, "", ErrFrameTruncated},
+		{"no payload", rawFrame(5, FrameVersion, FramePublish, ""), 16, "", ErrFrameTruncated},
+		{"truncated payload", rawFrame(5, FrameVersion, FramePublish, "hel"), 16, "", ErrFrameTruncated},
+		{"oversize", rawFrame(17, FrameVersion, FramePublish, "0123456789abcdefg"), 16, "", ErrFrameTooLarge},
+		{"oversize without payload", rawFrame(1<<31, FrameVersion, FramePublish, ""), 16, "", ErrFrameTooLarge},
+		{"unsupported version", rawFrame(2, FrameVersion+1, FramePublish, "hi"), 16, "", ErrUnsupportedVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame, err := ReadFrame(bytes.NewReader(tt.data), tt.maxSize)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("got error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(frame.Payload) != tt.want {
+				t.Fatalf("got payload %q, want %q", frame.Payload, tt.want)
+			}
+		})
+	}
+}
+
+// The payload of an oversize frame is left unread, however large it claims
+// to be
+func TestReadFrameOversizeLeavesPayload(t *testing.T) {
+	r := bytes.NewReader(rawFrame(8, FrameVersion, FramePublish, "too long"))
+	if _, err := ReadFrame(r, 4); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("got error %v, want %v", err, ErrFrameTooLarge)
+	}
+	if r.Len() != len("too long") {
+		t.Fatalf("%d bytes left to read, want the payload", r.Len())
+	}
+}
+
+func TestFrameWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		size   int
+		want   []string
+	}{
+		{"nothing", nil, 4, nil},
+		{"under a frame", []string{"ab"}, 4, []string{"ab"}},
+		{"exactly a frame", []string{"abcd"}, 4, []string{"abcd"}},
+		{"one write over frames", []string{"abcdefghij"}, 4, []string{"abcd", "efgh", "ij"}},
+		{"small writes", []string{"ab", "cd", "e", "fgh"}, 3, []string{"abc", "def", "gh"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			w := NewFrameWriter(&out, FrameExportChunk, tt.size)
+			for _, s := range tt.writes {
+				if n, err := w.Write([]byte(s)); err != nil || n != len(s) {
+					t.Fatalf("write of %q returned %d, %v", s, n, err)
+				}
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			r := bufio.NewReader(&out)
+			var got []string
+			for r.Buffered() > 0 || out.Len() > 0 {
+				frame, err := ReadFrame(r, uint32(tt.size))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if frame.Type != FrameExportChunk {
+					t.Fatalf("frame of type %d", frame.Type)
+				}
+				got = append(got, string(frame.Payload))
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got frames %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got frames %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
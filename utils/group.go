@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"errors"
+	"net"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Consumer groups share one connection entry in the topic pool, so the group
+// has a single cursor, pending queue and committed position. Every member
+// pulls from the shared pending queue, each message therefore goes to exactly
+// one member. When a member leaves, the messages it had in flight go back to
+// the queue for the other members.
+const groupConnectionPrefix = "group/"
+
+type ConsumerGroup struct {
+	Name         string
+	ConnectionID string              // ID of the connection shared by the members in the topic pool
+	Members      map[string]net.Conn // Map of member ID to its network connection
+}
+
+// Add a member to a consumer group, creating the group from its stored
+// position if it is the first member. A new group starts at the beginning of
+// the topic if replay is set, or at the end of it otherwise. Return the ID of
+// the connection shared by the group, and whether the member created the
+// group. Only the member creating the group may move it to its start
+// position, the others would drop the messages in flight of the group. Like
+// SubscribeDurable, a group created after the retention policy deleted its
+// stored position starts from the oldest message left, with an
+// ErrPositionDeleted error.
+func (tm *TopicManager) JoinGroup(db *badger.DB, logger *LoggerType, topic, group, memberId string, conn net.Conn, replay bool) (string, bool, error) {
+	pool, err := tm.lockPool(topic)
+	if err != nil {
+		return "", false, err
+	}
+	defer pool.Mutex.Unlock()
+
+	var moved error
+	g, exists := pool.Groups[group]
+	if !exists {
+		if pool.durableConnection(group) != nil {
+			// Name taken by a durable subscription
+			return "", false, ErrSubscriptionInUse
+		}
+		if err := tm.checkSubscriptions(pool); err != nil {
+			return "", false, err
+		}
+		var state *SubscriptionState
+		state, moved = pool.openSubscription(db, group, replay, true)
+		if moved != nil && !errors.Is(moved, ErrPositionDeleted) {
+			return "", false, moved
+		}
+
+		c := newConsumerConnection(groupConnectionPrefix+group, nil, state.NextOffset)
+		c.Subscription = group
+		c.group = true
+		c.attempts = pool.subscriptionAttempts(group)
+		if err := c.restoreDelayed(db, topic, state.Delayed, pool.Schedule); err != nil {
+			return "", false, err
+		}
+		pool.Connections[c.ID] = c
+		g = &ConsumerGroup{
+			Name:         group,
+			ConnectionID: c.ID,
+			Members:      make(map[string]net.Conn),
+		}
+		pool.Groups[group] = g
+	}
+
+	g.Members[memberId] = conn
+	logger.Info("Member %s joined group %s of topic %s, rebalanced over %d members", memberId, group, topic, len(g.Members))
+	return g.ConnectionID, !exists, moved
+}
+
+// Remove a member from a consumer group, the group goes away with its last
+// member. The messages in flight of the member must be released first so the
+// other members get them.
+func (tm *TopicManager) LeaveGroup(logger *LoggerType, topic, group, memberId string) {
+	pool, exists := tm.GetPool(topic)
+	if !exists {
+		return
+	}
+
+	pool.Mutex.Lock()
+	defer pool.Mutex.Unlock()
+
+	g, exists := pool.Groups[group]
+	if !exists {
+		return
+	}
+	delete(g.Members, memberId)
+	if len(g.Members) == 0 {
+		delete(pool.Groups, group)
+		delete(pool.Connections, g.ConnectionID)
+		logger.Info("Member %s left group %s of topic %s, group has no member left", memberId, group, topic)
+		return
+	}
+	logger.Info("Member %s left group %s of topic %s, rebalanced over %d members", memberId, group, topic, len(g.Members))
+}
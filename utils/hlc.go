@@ -98,31 +98,27 @@ func (c *HLC) Update(recvP, recvL int64) {
 
 	c.Physical = max(localPhysical, max(c.Physical, recvP))
 
-	// if localPhysical > c.physical {
-	// 	c.physical = localPhysical
-	// 	c.logical = 0
-	// }
-
-	// if recvP > c.physical {
-	// 	c.physical = recvP
-	// 	c.logical = recvL + 1
-	// } else if recvP == c.physical {
-	// 	c.logical = max(c.logical, recvL) + 1
-	// } else {
-	// 	c.logical++
-	// }
-
-	if c.Physical == localPhysical {
-		c.Logical = 0
-	} else if c.Physical == hlcPhysical && c.Physical == recvP {
+	// The local clock only resets the logical counter when it is ahead of both
+	// the previous and the received timestamp, otherwise the new timestamp
+	// could end up equal to or before one already given out
+	if c.Physical == hlcPhysical && c.Physical == recvP {
 		c.Logical = max(c.Logical, recvL) + 1
 	} else if c.Physical == hlcPhysical {
 		c.Logical++
 	} else if c.Physical == recvP {
 		c.Logical = recvL + 1
+	} else {
+		c.Logical = 0
 	}
 }
 
+// Timestamp for a received event, always after the sender timestamp and any
+// local event
+func (c *HLC) Receive(recvP, recvL int64) (int64, int64) {
+	c.Update(recvP, recvL)
+	return c.Now()
+}
+
 func max(a, b int64) int64 {
 	if a > b {
 		return a
@@ -3,16 +3,26 @@ package utils
 import (
 	"bytes"
 	"container/heap"
+	"context"
 	"encoding/gob"
+	"maps"
 	"sync"
+	"time"
 )
 
 // Metadata struct
 type Metadata struct {
-	Role   string
-	Token  string
-	Topic  string
-	Replay bool
+	Role         string
+	Token        string
+	Topic        string
+	Replay       bool
+	Subscription string        // Durable subscription name, the broker remembers its position
+	Group        string        // Consumer group name, members of a group share the messages of the topic
+	Start        StartPosition // Where to start reading the topic, overrides Replay and the stored position of a durable subscription
+	Pull         bool          // The consumer fetches messages itself instead of having them pushed
+	Credit       Credit        // Window of unacknowledged messages the broker may push, one message if zero
+	MaxFrameSize uint32        // Max payload size of the frames the consumer reads, DefaultMaxFrameSize if zero
+	Namespace    string        // Namespace of the topics of the connection, the default namespace if empty
 }
 
 // Client Message struct
@@ -23,16 +33,39 @@ type ClientMessage struct {
 
 // Message structure with HLC
 type HLCMsg struct {
-	ID       string
-	Content  string
-	Physical int64
-	Logical  int64
+	ID string
+	// Deprecated: body of the messages of older clients and brokers, it is
+	// moved to Body when the message is decoded or stored
+	Content     string
+	Body        []byte
+	ContentType string // MIME type of the body, free for the producer to set
+	Topic       string // Topic the message was delivered from, set by the broker on the copy sent to a consumer
+	Physical    int64
+	Logical     int64
+	Offset      uint64 // Position in the topic, assigned by the broker when the message is stored
+	Attempt     int    // Delivery attempt, set by the broker on the copy sent to a consumer
+	Headers     map[string]string
+	// Unix nanoseconds before which the message is not delivered, 0 for right away
+	DeliverAt int64
+	// Delay before the message is delivered, turned into DeliverAt by the broker
+	Delay time.Duration
+	// Unix nanoseconds after which the message is never delivered, 0 if it does not expire
+	ExpiresAt int64
+	// Time to live of the message, turned into ExpiresAt by the broker
+	TTL time.Duration
+	// Messages with the same key replace each other in a compacted topic
+	Key string
+	// Deletes its key from a compacted topic, the content is ignored
+	Tombstone bool
 }
 
 type MessageHeap []*HLCMsg
 
 func (h MessageHeap) Len() int { return len(h) }
 func (h MessageHeap) Less(i, j int) bool {
+	if h[i].Offset != h[j].Offset {
+		return h[i].Offset < h[j].Offset
+	}
 	if h[i].Physical == h[j].Physical {
 		return h[i].Logical < h[j].Logical
 	}
@@ -53,17 +86,19 @@ func (h *MessageHeap) Pop() interface{} {
 }
 
 type MessageQueue struct {
-	mu    sync.Mutex
-	heap  *MessageHeap
-	clock *HLC
+	mu     sync.Mutex
+	heap   *MessageHeap
+	clock  *HLC
+	notify chan struct{} // Signaled when a message is added or on Notify
 }
 
 func NewMessageQueue() *MessageQueue {
 	h := &MessageHeap{}
 	heap.Init(h)
 	return &MessageQueue{
-		heap:  h,
-		clock: NewHLC(),
+		heap:   h,
+		clock:  NewHLC(),
+		notify: make(chan struct{}, 1),
 	}
 }
 
@@ -80,6 +115,47 @@ func (q *MessageQueue) AddMessage(msg *HLCMsg) {
 	// }
 
 	heap.Push(q.heap, msg)
+	q.Notify()
+}
+
+// Wake up a goroutine blocked in Wait, or the next one to call it
+func (q *MessageQueue) Notify() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Block until a message was added or Notify was called since the last Wait,
+// or until the context is done
+func (q *MessageQueue) Wait(ctx context.Context) error {
+	select {
+	case <-q.Ready():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Channel signaled when a message is added or on Notify, to wait on the queue
+// together with other events
+func (q *MessageQueue) Ready() <-chan struct{} {
+	return q.notify
+}
+
+// Drop every message of the queue
+func (q *MessageQueue) Clear() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	*q.heap = (*q.heap)[:0]
+}
+
+func (q *MessageQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.heap.Len()
 }
 
 func (q *MessageQueue) PeekNextMessage() *HLCMsg {
@@ -92,6 +168,23 @@ func (q *MessageQueue) PeekNextMessage() *HLCMsg {
 	return (*q.heap)[0]
 }
 
+// Lowest offset of the queued messages accepted by keep
+func (q *MessageQueue) FirstOffset(keep func(*HLCMsg) bool) (uint64, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.heap.Len() > 0 && keep((*q.heap)[0]) {
+		return (*q.heap)[0].Offset, true
+	}
+	first, found := uint64(0), false
+	for _, msg := range *q.heap {
+		if keep(msg) && (!found || msg.Offset < first) {
+			first, found = msg.Offset, true
+		}
+	}
+	return first, found
+}
+
 func (q *MessageQueue) GetNextMessage() *HLCMsg {
 	q.mu.Lock()
 	defer q.mu.Unlock()
@@ -100,10 +193,35 @@ func (q *MessageQueue) GetNextMessage() *HLCMsg {
 		return nil
 	}
 	temp := heap.Pop(q.heap).(*HLCMsg)
+	if q.heap.Len() > 0 {
+		// Pass the wake up on, the queue can be shared by several consumers
+		q.Notify()
+	}
 
 	return temp
 }
 
+// Pop the next message if take accepts it. A refused message stays at the
+// head of the queue and refused is set, the wake up is passed on to another
+// consumer sharing the queue.
+func (q *MessageQueue) GetNextMessageIf(take func(*HLCMsg) bool) (msg *HLCMsg, refused bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.heap.Len() == 0 {
+		return nil, false
+	}
+	if !take((*q.heap)[0]) {
+		q.Notify()
+		return nil, true
+	}
+	msg = heap.Pop(q.heap).(*HLCMsg)
+	if q.heap.Len() > 0 {
+		q.Notify()
+	}
+	return msg, false
+}
+
 func (q *MessageQueue) UpdateClock(remotePhysical, remoteLogical int64) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
@@ -131,6 +249,9 @@ func MessageDecode(data []byte) (ClientMessage, error) {
 	if err != nil {
 		return ClientMessage{}, err
 	}
+	if message.Payload != nil {
+		message.Payload.upgradeContent()
+	}
 	return message, nil
 }
 
@@ -199,12 +320,37 @@ func DecodeQueue(data []byte) (*MessageQueue, error) {
 	return mq, nil
 }
 
+// Body of the message as a string
+func (m *HLCMsg) Text() string {
+	return string(m.Body)
+}
+
+// Move the body of a message from an older client or broker to Body
+func (m *HLCMsg) upgradeContent() {
+	if m.Body == nil && m.Content != "" {
+		m.Body = []byte(m.Content)
+		m.Content = ""
+	}
+}
+
 func (m *HLCMsg) DeepCopy() *HLCMsg {
 	return &HLCMsg{
-		ID:       m.ID,
-		Content:  m.Content,
-		Physical: m.Physical,
-		Logical:  m.Logical,
+		ID:          m.ID,
+		Content:     m.Content,
+		Body:        bytes.Clone(m.Body),
+		ContentType: m.ContentType,
+		Topic:       m.Topic,
+		Physical:    m.Physical,
+		Logical:     m.Logical,
+		Offset:      m.Offset,
+		Attempt:     m.Attempt,
+		Headers:     maps.Clone(m.Headers),
+		DeliverAt:   m.DeliverAt,
+		Delay:       m.Delay,
+		ExpiresAt:   m.ExpiresAt,
+		TTL:         m.TTL,
+		Key:         m.Key,
+		Tombstone:   m.Tombstone,
 	}
 }
 
@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Messages of older clients carry their body in Content, it is moved to Body
+// when they are decoded
+func TestMessageDecodeLegacyContent(t *testing.T) {
+	data, err := MessageEncode(&ClientMessage{Payload: &HLCMsg{Content: "legacy"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := MessageDecode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Payload.Text() != "legacy" || message.Payload.Content != "" {
+		t.Fatalf("decoded body %q and content %q", message.Payload.Body, message.Payload.Content)
+	}
+}
+
+func TestMessageEncodeBinaryBody(t *testing.T) {
+	body := []byte{0, 0xff, 0xfe, '\n', 0}
+	data, err := MessageEncode(&ClientMessage{Payload: &HLCMsg{
+		Body:        body,
+		ContentType: "application/octet-stream",
+		Headers:     map[string]string{"trace-id": "abc"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := MessageDecode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := message.Payload
+	if !bytes.Equal(msg.Body, body) || msg.ContentType != "application/octet-stream" || msg.Headers["trace-id"] != "abc" {
+		t.Fatalf("decoded %+v", msg)
+	}
+}
+
+// A deep copy shares neither the body nor the headers of the message
+func TestDeepCopy(t *testing.T) {
+	msg := &HLCMsg{Body: []byte("body"), Headers: map[string]string{"k": "v"}}
+	copied := msg.DeepCopy()
+	copied.Body[0] = 'B'
+	copied.Headers["k"] = "changed"
+	if msg.Text() != "body" || msg.Headers["k"] != "v" {
+		t.Fatalf("changing the copy changed the message to %q %v", msg.Body, msg.Headers)
+	}
+}
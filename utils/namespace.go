@@ -0,0 +1,178 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Topics of a namespace are known to the topic manager and stored under their
+// qualified name
+//
+//	<namespace>::<topic>
+//
+// so every key of a namespace is one of the key prefixes followed by
+// "<namespace>::", and a namespace can be exported or dropped by prefix.
+// Topics of the default namespace "" keep their bare name.
+const namespaceSeparator = "::"
+
+var (
+	ErrInvalidNamespace  = errors.New("namespace must be 1 to 64 letters, digits, '.', '_' or '-'")
+	ErrInvalidTopic      = errors.New("topic name must not be empty nor contain \"::\"")
+	ErrNamespaceInUse    = errors.New("namespace has connected consumers")
+	ErrNamespaceDeleting = errors.New("namespace is being deleted")
+)
+
+var namespacePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Namespace as reported to admin clients
+type NamespaceInfo struct {
+	Name   string
+	Topics int
+}
+
+// Check a namespace name, the default namespace "" is valid
+func ValidateNamespace(namespace string) error {
+	if namespace != "" && !namespacePattern.MatchString(namespace) {
+		return ErrInvalidNamespace
+	}
+	return nil
+}
+
+// Check a topic name given by a client
+func ValidateTopic(topic string) error {
+	if topic == "" || strings.Contains(topic, namespaceSeparator) {
+		return ErrInvalidTopic
+	}
+	return nil
+}
+
+// Name of a topic of a namespace for the topic manager and the store
+func QualifiedTopic(namespace, topic string) string {
+	if namespace == "" {
+		return topic
+	}
+	return namespace + namespaceSeparator + topic
+}
+
+// Namespace and name within it of a qualified topic
+func SplitTopic(qualified string) (namespace, topic string) {
+	if namespace, topic, ok := strings.Cut(qualified, namespaceSeparator); ok {
+		return namespace, topic
+	}
+	return "", qualified
+}
+
+// List the namespaces holding at least one topic, the default one included
+func (tm *TopicManager) ListNamespaces() []NamespaceInfo {
+	tm.Mutex.RLock()
+	topics := make(map[string]int)
+	for topic := range tm.Pools {
+		namespace, _ := SplitTopic(topic)
+		topics[namespace]++
+	}
+	tm.Mutex.RUnlock()
+
+	namespaces := make([]NamespaceInfo, 0, len(topics))
+	for name, n := range topics {
+		namespaces = append(namespaces, NamespaceInfo{Name: name, Topics: n})
+	}
+	sort.Slice(namespaces, func(i, j int) bool {
+		return namespaces[i].Name < namespaces[j].Name
+	})
+	return namespaces
+}
+
+// Whether a key of the store belongs to the namespace
+func namespaceKey(key []byte, namespace string) bool {
+	for _, prefix := range keyPrefixes {
+		if bytes.HasPrefix(key, []byte(prefix+namespace+namespaceSeparator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Write a badger backup of every key of a namespace to w, it can be loaded
+// into the store of another broker with badger's DB.Load before it starts
+func ExportNamespace(db *badger.DB, namespace string, w io.Writer) error {
+	if namespace == "" {
+		return ErrInvalidNamespace
+	}
+	stream := db.NewStream()
+	stream.LogPrefix = "Export namespace " + namespace
+	stream.ChooseKey = func(item *badger.Item) bool {
+		return namespaceKey(item.Key(), namespace)
+	}
+	_, err := stream.Backup(w, 0)
+	return err
+}
+
+// Delete every topic of a namespace with its messages, subscriptions and
+// settings. The namespace can not have connected consumers. Publishes,
+// subscriptions and settings to the namespace fail with ErrNamespaceDeleting
+// until its keys are dropped.
+func (tm *TopicManager) DeleteNamespace(db *badger.DB, logger *LoggerType, namespace string) error {
+	if namespace == "" {
+		return ErrInvalidNamespace
+	}
+
+	tm.Mutex.Lock()
+	if tm.deleting[namespace] {
+		tm.Mutex.Unlock()
+		return ErrNamespaceDeleting
+	}
+	var pools []*TopicPool
+	for topic, pool := range tm.Pools {
+		if ns, _ := SplitTopic(topic); ns == namespace {
+			pools = append(pools, pool)
+		}
+	}
+	// Wait for the writes in progress, none can start on these pools while
+	// the manager is locked
+	for _, pool := range pools {
+		pool.Mutex.Lock()
+	}
+	unlock := func() {
+		for _, pool := range pools {
+			pool.Mutex.Unlock()
+		}
+		tm.Mutex.Unlock()
+	}
+	for _, pool := range pools {
+		if len(pool.Connections) > 0 {
+			unlock()
+			return ErrNamespaceInUse
+		}
+	}
+	for _, pool := range pools {
+		pool.deleted = true
+		delete(tm.Pools, pool.Topic)
+		pool.Schedule.stop()
+	}
+	tm.deleting[namespace] = true
+	unlock()
+	tm.namespaceMu.Lock()
+	delete(tm.namespaceBytes, namespace)
+	tm.namespaceMu.Unlock()
+	defer func() {
+		tm.Mutex.Lock()
+		delete(tm.deleting, namespace)
+		tm.Mutex.Unlock()
+	}()
+
+	prefixes := make([][]byte, len(keyPrefixes))
+	for i, prefix := range keyPrefixes {
+		prefixes[i] = []byte(prefix + namespace + namespaceSeparator)
+	}
+	if err := db.DropPrefix(prefixes...); err != nil {
+		return err
+	}
+	logger.Info("Deleted namespace %s and its %d topics", namespace, len(pools))
+	return nil
+}
@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestNamespaceBeingDeletedRefusesWrites(t *testing.T) {
+	db := openTestDB(t)
+	logger := testLogger()
+	tm := NewTopicManager(logger)
+	if err := tm.PublishMessage(db, logger, "acme::orders", &HLCMsg{Body: []byte("one")}); err != nil {
+		t.Fatal(err)
+	}
+	pool, _ := tm.GetPool("acme::orders")
+
+	tm.deleting["acme"] = true
+	writes := map[string]func(topic string) error{
+		"publish": func(topic string) error {
+			return tm.PublishMessage(db, logger, topic, &HLCMsg{Body: []byte("two")})
+		},
+		"config": func(topic string) error {
+			return tm.SetTopicConfig(db, topic, TopicConfig{})
+		},
+		"subscribe": func(topic string) error {
+			return tm.SubscribeConsumer(topic, "consumer", nil)
+		},
+	}
+	for name, write := range writes {
+		if err := write("acme::orders"); !errors.Is(err, ErrNamespaceDeleting) {
+			t.Errorf("%s to a namespace being deleted returned %v", name, err)
+		}
+		if err := write("other::orders"); err != nil {
+			t.Errorf("%s to another namespace: %v", name, err)
+		}
+	}
+	delete(tm.deleting, "acme")
+
+	// A pool dropped with its namespace is not written to by those holding it
+	if err := tm.DeleteNamespace(db, logger, "acme"); err != nil {
+		t.Fatal(err)
+	}
+	if !pool.deleted {
+		t.Fatal("pool of a deleted namespace not marked deleted")
+	}
+	if err := tm.PublishMessage(db, logger, "acme::orders", &HLCMsg{Body: []byte("three")}); err != nil {
+		t.Fatalf("publish once the namespace is deleted: %v", err)
+	}
+}
+
+// Publishes racing a deletion either land before it and are dropped, or
+// after it in a new topic, none is left in the store without its topic
+func TestDeleteNamespaceWithConcurrentPublishes(t *testing.T) {
+	for round := 0; round < 20; round++ {
+		db := openTestDB(t)
+		logger := testLogger()
+		tm := NewTopicManager(logger)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					err := tm.PublishMessage(db, logger, "acme::orders", &HLCMsg{Body: []byte("message")})
+					if err != nil && !errors.Is(err, ErrNamespaceDeleting) {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+		}
+		if err := tm.DeleteNamespace(db, logger, "acme"); err != nil {
+			t.Fatal(err)
+		}
+		wg.Wait()
+
+		var next uint64
+		if pool, exists := tm.GetPool("acme::orders"); exists {
+			next = pool.NextOffset
+		}
+		var stored uint64
+		txn := db.NewTransaction(false)
+		err := iterateMessageSizes(txn, "acme::orders", 0, ^uint64(0), func(offset uint64, valueSize int64) error {
+			stored++
+			return nil
+		})
+		txn.Discard()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored != next {
+			t.Fatalf("round %d: %d messages stored, the topic has %d", round, stored, next)
+		}
+	}
+}
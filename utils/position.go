@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+type StartKind uint8
+
+const (
+	StartDefault  StartKind = iota // End of the topic, or its start on replay, or the stored position of a durable subscription
+	StartEarliest                  // First message still stored
+	StartLatest                    // Only messages published from now on
+	StartAtOffset                  // Message at the given offset
+	StartAtTime                    // First message stamped at or after the given HLC timestamp
+)
+
+// Position in a topic a consumer starts reading from, on subscribe or seek
+type StartPosition struct {
+	Kind     StartKind
+	Offset   uint64
+	Physical int64
+	Logical  int64
+}
+
+func FromEarliest() StartPosition {
+	return StartPosition{Kind: StartEarliest}
+}
+
+func FromLatest() StartPosition {
+	return StartPosition{Kind: StartLatest}
+}
+
+func FromOffset(offset uint64) StartPosition {
+	return StartPosition{Kind: StartAtOffset, Offset: offset}
+}
+
+// Start at the first message stamped at or after a wall clock time
+func FromTime(t time.Time) StartPosition {
+	return StartPosition{Kind: StartAtTime, Physical: t.UnixNano()}
+}
+
+// Start at the first message stamped at or after an HLC timestamp
+func FromHLC(physical, logical int64) StartPosition {
+	return StartPosition{Kind: StartAtTime, Physical: physical, Logical: logical}
+}
+
+// Offset of a start position in a topic
+func (tm *TopicManager) ResolvePosition(db *badger.DB, topic string, pos StartPosition) (uint64, error) {
+	pool, exists := tm.GetPool(topic)
+	if !exists {
+		return 0, nil
+	}
+
+	pool.Mutex.RLock()
+	first, end := pool.FirstOffset, pool.NextOffset
+	pool.Mutex.RUnlock()
+
+	switch pos.Kind {
+	case StartEarliest:
+		return first, nil
+	case StartAtOffset:
+		if pos.Offset < first {
+			return 0, positionDeleted(first)
+		}
+		return min(pos.Offset, end), nil
+	case StartAtTime:
+		offset, err := tm.offsetForTime(db, pool, first, end, pos.Physical, pos.Logical)
+		if err != nil {
+			return 0, err
+		}
+		if offset == first && first > 0 {
+			// The deleted messages may have been stamped after the requested
+			// time, unless the oldest message left is stamped at it
+			m, err := firstMessage(db, topic, first, end)
+			if err != nil {
+				return 0, err
+			}
+			if m == nil || m.Physical > pos.Physical || (m.Physical == pos.Physical && m.Logical > pos.Logical) {
+				return 0, positionDeleted(first)
+			}
+		}
+		return offset, nil
+	default:
+		return end, nil
+	}
+}
+
+// Binary search of the first message stamped at or after the given HLC
+// timestamp. Messages are stamped by the topic clock when they are committed,
+// so timestamps grow with offsets.
+func (tm *TopicManager) offsetForTime(db *badger.DB, pool *TopicPool, first, end uint64, physical, logical int64) (uint64, error) {
+	lo, hi := first, end
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+
+		pool.Mutex.RLock()
+		messages, inMemory := pool.MessageLog.Range(mid, mid+1)
+		pool.Mutex.RUnlock()
+		var m *HLCMsg
+		if inMemory && len(messages) > 0 {
+			m = messages[0]
+		} else {
+			// Messages can be deleted from the store, compare with the next
+			// one still there
+			var err error
+			m, err = firstMessage(db, pool.Topic, mid, hi)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		if m == nil {
+			hi = mid
+		} else if m.Physical < physical || (m.Physical == physical && m.Logical < logical) {
+			lo = m.Offset + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
+// Move a consumer, or the whole group it belongs to, to a new position. The
+// pending messages and the messages in flight are dropped, and a durable
+// subscription stores its new position straight away. Return the offset of
+// the next message the consumer gets.
+func (tm *TopicManager) Seek(db *badger.DB, topic, consumerId string, pos StartPosition) (uint64, error) {
+	offset, err := tm.ResolvePosition(db, topic, pos)
+	if err != nil {
+		return 0, err
+	}
+
+	_, c, exists := tm.GetConnection(topic, consumerId)
+	if !exists {
+		return 0, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.PendingMessage.Clear()
+	clear(c.inflight)
+	c.attempts.reset()
+	clear(c.held)
+	clear(c.delayed)
+	c.NextOffset = offset
+	if c.Subscription == "" {
+		return offset, nil
+	}
+	c.committed = offset
+	return offset, c.saveState(db, topic)
+}
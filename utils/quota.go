@@ -0,0 +1,254 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// How often a rate limiter drops the buckets that filled up again, a missing
+// bucket stands for a full one
+const bucketSweepInterval = time.Minute
+
+// Token buckets of a per second rate, one per key. A bucket holds up to one
+// second worth of tokens and can go into debt, the debt is the time the
+// caller waits before going on. A nil limiter has no limit.
+type RateLimiter struct {
+	rate    float64
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time // Last time full buckets were dropped
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter of rate per second and key, nil if rate is 0
+func NewRateLimiter(rate float64) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &RateLimiter{rate: rate, buckets: make(map[string]*bucket), swept: time.Now()}
+}
+
+// Tokens of a bucket refilled up to now
+func (l *RateLimiter) refill(b *bucket, now time.Time) float64 {
+	return min(l.rate, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+}
+
+// Drop the buckets of the keys that stopped publishing long enough to be
+// full again, so idle clients and topics take no memory
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= l.rate {
+			delete(l.buckets, key)
+		}
+	}
+	l.swept = now
+}
+
+// Take n tokens from the bucket of key and return how long the caller must
+// wait for them. Nothing is taken and false is returned if the wait would be
+// longer than maxWait.
+func (l *RateLimiter) Reserve(key string, n float64, maxWait time.Duration) (time.Duration, bool) {
+	if l == nil {
+		return 0, true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.swept) >= bucketSweepInterval {
+		l.sweep(now)
+	}
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &bucket{tokens: l.rate, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.last = now
+
+	var wait time.Duration
+	if left := b.tokens - n; left < 0 {
+		wait = time.Duration(-left / l.rate * float64(time.Second))
+	}
+	if wait > maxWait {
+		return 0, false
+	}
+	b.tokens -= n
+	return wait, true
+}
+
+// Give back tokens taken by Reserve
+func (l *RateLimiter) Cancel(key string, n float64) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if b, exists := l.buckets[key]; exists {
+		b.tokens = min(l.rate, b.tokens+n)
+	}
+}
+
+// Publish rates of the broker, per client, per namespace and per topic. A
+// publish over a rate is held back until the rate allows it, or rejected if it
+// would be held back longer than MaxWait.
+type PublishQuotas struct {
+	ClientMessages    *RateLimiter // Messages per second of a client
+	ClientBytes       *RateLimiter // Body bytes per second of a client
+	NamespaceMessages *RateLimiter // Messages per second of the topics of a namespace
+	NamespaceBytes    *RateLimiter // Body bytes per second of the topics of a namespace
+	TopicMessages     *RateLimiter // Messages per second of a topic
+	TopicBytes        *RateLimiter // Body bytes per second of a topic
+	MaxWait           time.Duration
+}
+
+// Tokens a publish takes from each rate limiter
+type publishLimit struct {
+	limiter *RateLimiter
+	key     string
+	n       float64
+	name    string
+}
+
+func (q *PublishQuotas) limits(client, topic string, messages []*HLCMsg) []publishLimit {
+	size := 0
+	for _, message := range messages {
+		size += len(message.Body)
+	}
+	namespace, _ := SplitTopic(topic)
+	return []publishLimit{
+		{q.ClientMessages, client, float64(len(messages)), "messages per second of client " + client},
+		{q.ClientBytes, client, float64(size), "bytes per second of client " + client},
+		{q.NamespaceMessages, namespace, float64(len(messages)), fmt.Sprintf("messages per second of namespace %q", namespace)},
+		{q.NamespaceBytes, namespace, float64(size), fmt.Sprintf("bytes per second of namespace %q", namespace)},
+		{q.TopicMessages, topic, float64(len(messages)), "messages per second of topic " + topic},
+		{q.TopicBytes, topic, float64(size), "bytes per second of topic " + topic},
+	}
+}
+
+// Account for a publish of messages to a topic by a client and return how
+// long to hold it back, or an error matching ErrQuotaExceeded
+func (q *PublishQuotas) Throttle(client, topic string, messages []*HLCMsg) (time.Duration, error) {
+	limits := q.limits(client, topic, messages)
+	var wait time.Duration
+	for i, limit := range limits {
+		w, ok := limit.limiter.Reserve(limit.key, limit.n, q.MaxWait)
+		if !ok {
+			for _, taken := range limits[:i] {
+				taken.limiter.Cancel(taken.key, taken.n)
+			}
+			return 0, fmt.Errorf("%w: %s", ErrQuotaExceeded, limit.name)
+		}
+		if w > wait {
+			wait = w
+		}
+	}
+	return wait, nil
+}
+
+// Give back the tokens taken by Throttle for a publish that was not stored
+func (q *PublishQuotas) Cancel(client, topic string, messages []*HLCMsg) {
+	for _, limit := range q.limits(client, topic, messages) {
+		limit.limiter.Cancel(limit.key, limit.n)
+	}
+}
+
+// Refuse a publish of size encoded bytes that would take the stored messages
+// of a topic over MaxStoredBytes. Sizes are counted as stored, like
+// StoredBytes. Must be called with the pool mutex held.
+func (tm *TopicManager) checkStoredBytes(pool *TopicPool, size int64) error {
+	if tm.MaxStoredBytes <= 0 {
+		return nil
+	}
+	if pool.StoredBytes+size > tm.MaxStoredBytes {
+		return fmt.Errorf("%w: topic %s stores %d bytes, the limit is %d", ErrQuotaExceeded, pool.Topic, pool.StoredBytes, tm.MaxStoredBytes)
+	}
+	return nil
+}
+
+// Refuse a publish of size encoded bytes that would take the topics of a
+// namespace over MaxNamespaceStoredBytes, and count the bytes as stored by the
+// namespace otherwise. A publish failing after that gives them back with
+// addNamespaceBytes.
+func (tm *TopicManager) reserveNamespaceBytes(namespace string, size int64) error {
+	tm.namespaceMu.Lock()
+	defer tm.namespaceMu.Unlock()
+
+	stored := tm.namespaceBytes[namespace]
+	if tm.MaxNamespaceStoredBytes > 0 && stored+size > tm.MaxNamespaceStoredBytes {
+		return fmt.Errorf("%w: namespace %q stores %d bytes, the limit is %d", ErrQuotaExceeded, namespace, stored, tm.MaxNamespaceStoredBytes)
+	}
+	tm.namespaceBytes[namespace] = stored + size
+	return nil
+}
+
+func (tm *TopicManager) addNamespaceBytes(namespace string, delta int64) {
+	if delta == 0 {
+		return
+	}
+	tm.namespaceMu.Lock()
+	defer tm.namespaceMu.Unlock()
+
+	tm.namespaceBytes[namespace] += delta
+}
+
+// Refuse a new subscription past MaxSubscriptions, a consumer group counts as
+// one. Must be called with the pool mutex held.
+func (tm *TopicManager) checkSubscriptions(pool *TopicPool) error {
+	if tm.MaxSubscriptions > 0 && len(pool.Connections) >= tm.MaxSubscriptions {
+		return fmt.Errorf("%w: topic %s has %d subscriptions, the limit is %d", ErrQuotaExceeded, pool.Topic, len(pool.Connections), tm.MaxSubscriptions)
+	}
+	return nil
+}
+
+// Recount the bytes stored by every topic, once messages were deleted
+func (tm *TopicManager) CountStoredBytes(db *badger.DB) error {
+	tm.Mutex.RLock()
+	pools := make([]*TopicPool, 0, len(tm.Pools))
+	for _, pool := range tm.Pools {
+		pools = append(pools, pool)
+	}
+	tm.Mutex.RUnlock()
+
+	for _, pool := range pools {
+		// Messages stored while counting are added on top of the count
+		pool.Mutex.Lock()
+		txn := db.NewTransaction(false)
+		before := pool.StoredBytes
+		pool.Mutex.Unlock()
+
+		size, err := storedBytes(txn, pool.Topic)
+		txn.Discard()
+		if err != nil {
+			return err
+		}
+
+		pool.Mutex.Lock()
+		pool.StoredBytes = size + pool.StoredBytes - before
+		pool.Mutex.Unlock()
+		namespace, _ := SplitTopic(pool.Topic)
+		tm.addNamespaceBytes(namespace, size-before)
+	}
+	return nil
+}
+
+// Size of the stored messages of a topic
+func storedBytes(txn *badger.Txn, topic string) (int64, error) {
+	var size int64
+	err := iterateMessageSizes(txn, topic, 0, ^uint64(0), func(offset uint64, valueSize int64) error {
+		size += valueSize
+		return nil
+	})
+	return size, err
+}
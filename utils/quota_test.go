@@ -0,0 +1,186 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+func testLogger() *LoggerType {
+	return &LoggerType{
+		InfoLogger:  log.New(io.Discard, "", 0),
+		ErrorLogger: log.New(io.Discard, "", 0),
+	}
+}
+
+func openTestDB(t *testing.T) *badger.DB {
+	t.Helper()
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestRateLimiterDropsFullBuckets(t *testing.T) {
+	l := NewRateLimiter(10)
+	for _, key := range []string{"idle", "busy"} {
+		if _, ok := l.Reserve(key, 5, time.Second); !ok {
+			t.Fatalf("reserve for %s refused", key)
+		}
+	}
+
+	// Half a second later idle is full again, busy took more since
+	now := time.Now().Add(500 * time.Millisecond)
+	l.buckets["busy"].last = now
+	l.sweep(now)
+	if _, exists := l.buckets["idle"]; exists {
+		t.Fatal("the full bucket of idle was kept")
+	}
+	if _, exists := l.buckets["busy"]; !exists {
+		t.Fatal("the bucket of busy was dropped before filling up")
+	}
+}
+
+func TestRateLimiterSweepsOnReserve(t *testing.T) {
+	l := NewRateLimiter(10)
+	for _, key := range []string{"a", "b", "c"} {
+		l.Reserve(key, 1, time.Second)
+	}
+	l.swept = time.Now().Add(-bucketSweepInterval)
+	for _, b := range l.buckets {
+		b.last = b.last.Add(-time.Second)
+	}
+	l.Reserve("d", 1, time.Second)
+	if len(l.buckets) != 1 {
+		t.Fatalf("%d buckets after a sweep, want 1", len(l.buckets))
+	}
+}
+
+// A dropped bucket comes back full, as if it had been kept
+func TestRateLimiterDroppedBucketIsFull(t *testing.T) {
+	l := NewRateLimiter(10)
+	l.Reserve("key", 10, time.Second)
+	l.sweep(time.Now().Add(2 * time.Second))
+	if wait, ok := l.Reserve("key", 10, 0); !ok || wait != 0 {
+		t.Fatalf("reserve after the bucket was dropped waits %s, ok %v", wait, ok)
+	}
+}
+
+// The stored bytes limit counts messages as they are stored, headers included,
+// the same as the recount does
+func TestStoredBytesLimit(t *testing.T) {
+	db := openTestDB(t)
+	logger := testLogger()
+	tm := NewTopicManager(logger)
+	body := strings.Repeat("x", 100)
+	if err := tm.PublishMessages(db, logger, "orders", []*HLCMsg{{Body: []byte(body)}}); err != nil {
+		t.Fatal(err)
+	}
+	pool, _ := tm.GetPool("orders")
+	one := pool.StoredBytes
+	if one <= int64(len(body)) {
+		t.Fatalf("one message counted as %d bytes, its body alone is %d", one, len(body))
+	}
+
+	// Room for a second message by body size, not once headers are counted
+	tm.MaxStoredBytes = one + int64(len(body))
+	err := tm.PublishMessages(db, logger, "orders", []*HLCMsg{{Body: []byte(body)}})
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("publish past the limit returned %v", err)
+	}
+	if pool.NextOffset != 1 {
+		t.Fatalf("next offset %d after a refused publish, want 1", pool.NextOffset)
+	}
+
+	if err := tm.CountStoredBytes(db); err != nil {
+		t.Fatal(err)
+	}
+	if pool.StoredBytes != one {
+		t.Fatalf("recounted %d stored bytes, counted %d on publish", pool.StoredBytes, one)
+	}
+	tm.MaxStoredBytes = 3 * one
+	if err := tm.PublishMessages(db, logger, "orders", []*HLCMsg{{Body: []byte(body)}}); err != nil {
+		t.Fatalf("publish under the limit: %v", err)
+	}
+}
+
+// The topics of a namespace share its stored bytes limit, other namespaces
+// have their own
+func TestNamespaceStoredBytesLimit(t *testing.T) {
+	db := openTestDB(t)
+	logger := testLogger()
+	tm := NewTopicManager(logger)
+	publish := func(topic string) error {
+		return tm.PublishMessage(db, logger, topic, &HLCMsg{Body: []byte(strings.Repeat("x", 100))})
+	}
+	if err := publish("acme::orders"); err != nil {
+		t.Fatal(err)
+	}
+	pool, _ := tm.GetPool("acme::orders")
+	tm.MaxNamespaceStoredBytes = pool.StoredBytes + pool.StoredBytes/2
+
+	if err := publish("acme::invoices"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("publish to another topic past the namespace limit returned %v", err)
+	}
+	if invoices, exists := tm.GetPool("acme::invoices"); exists && invoices.NextOffset != 0 {
+		t.Fatal("refused publish was stored")
+	}
+	if err := publish("other::orders"); err != nil {
+		t.Fatalf("publish to another namespace: %v", err)
+	}
+
+	// A refused publish gives its bytes back, the recount agrees
+	stored := tm.namespaceBytes["acme"]
+	if err := tm.CountStoredBytes(db); err != nil {
+		t.Fatal(err)
+	}
+	if tm.namespaceBytes["acme"] != stored || stored != pool.StoredBytes {
+		t.Fatalf("namespace counted %d bytes, recounted %d, its topic stores %d", stored, tm.namespaceBytes["acme"], pool.StoredBytes)
+	}
+
+	if err := tm.DeleteNamespace(db, logger, "acme"); err != nil {
+		t.Fatal(err)
+	}
+	if err := publish("acme::invoices"); err != nil {
+		t.Fatalf("publish to a deleted namespace created again: %v", err)
+	}
+}
+
+func TestThrottleNamespaceRates(t *testing.T) {
+	q := &PublishQuotas{NamespaceMessages: NewRateLimiter(2)}
+	message := []*HLCMsg{{Body: []byte("x")}}
+	for _, topic := range []string{"acme::orders", "acme::invoices"} {
+		if _, err := q.Throttle("alice", topic, message); err != nil {
+			t.Fatalf("publish to %s: %v", topic, err)
+		}
+	}
+	if _, err := q.Throttle("bob", "acme::orders", message); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("publish past the namespace rate returned %v", err)
+	}
+	if _, err := q.Throttle("bob", "other::orders", message); err != nil {
+		t.Fatalf("publish to another namespace: %v", err)
+	}
+}
+
+// A publish that was not stored gives its tokens back
+func TestThrottleCancel(t *testing.T) {
+	q := &PublishQuotas{ClientMessages: NewRateLimiter(1), TopicBytes: NewRateLimiter(10)}
+	message := []*HLCMsg{{Body: []byte("xxxxxxxx")}}
+	if _, err := q.Throttle("alice", "orders", message); err != nil {
+		t.Fatal(err)
+	}
+	q.Cancel("alice", "orders", message)
+	if _, err := q.Throttle("alice", "orders", message); err != nil {
+		t.Fatalf("publish after a cancelled one: %v", err)
+	}
+	if _, err := q.Throttle("alice", "orders", message); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("publish past the rate returned %v", err)
+	}
+}
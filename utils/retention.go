@@ -0,0 +1,198 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+var ErrPositionDeleted = errors.New("position was deleted by the retention policy of the topic")
+
+// Whether the config limits how long or how much a topic keeps
+func (c *TopicConfig) hasRetention() bool {
+	return c.MaxAge > 0 || c.MaxBytes > 0 || c.MaxMessages > 0
+}
+
+// Error for a position before the first offset still stored
+func positionDeleted(first uint64) error {
+	return fmt.Errorf("%w, first offset is %d", ErrPositionDeleted, first)
+}
+
+// Drop the oldest messages of the hot tail up to offset
+func (l *TopicLog) Truncate(offset uint64) {
+	if offset <= l.First {
+		return
+	}
+	drop := min(int(offset-l.First), len(l.messages))
+	for i := 0; i < drop; i++ {
+		l.messages[i] = nil
+	}
+	l.messages = l.messages[drop:]
+	l.First += uint64(drop)
+}
+
+// Delete the messages of every topic that fall out of its retention policy,
+// oldest first
+func (tm *TopicManager) ApplyRetention(db *badger.DB, logger *LoggerType) error {
+	tm.Mutex.RLock()
+	pools := make([]*TopicPool, 0, len(tm.Pools))
+	for _, pool := range tm.Pools {
+		pools = append(pools, pool)
+	}
+	tm.Mutex.RUnlock()
+
+	for _, pool := range pools {
+		pool.Mutex.RLock()
+		config := pool.Config
+		first, end := pool.FirstOffset, pool.NextOffset
+		pool.Mutex.RUnlock()
+		if !config.hasRetention() || first >= end {
+			continue
+		}
+
+		cut, err := retentionCut(db, pool.Topic, first, end, &config)
+		if err != nil {
+			return err
+		}
+		if cut <= first {
+			continue
+		}
+
+		// Move the start of the topic first, consumers stop reading the
+		// messages about to be deleted
+		pool.Mutex.Lock()
+		if cut > pool.FirstOffset {
+			pool.FirstOffset = cut
+		}
+		pool.MessageLog.Truncate(cut)
+		pool.Mutex.Unlock()
+
+		deleted, err := deleteMessages(db, pool.Topic, first, cut)
+		if err != nil {
+			return err
+		}
+		pool.retentionDeleted.Add(uint64(deleted))
+		logger.Info("Retention deleted %d messages of topic %s, first offset is now %d", deleted, pool.Topic, cut)
+	}
+	return nil
+}
+
+// First offset of a topic to keep under its retention policy
+func retentionCut(db *badger.DB, topic string, first, end uint64, config *TopicConfig) (uint64, error) {
+	cut := first
+	err := db.View(func(txn *badger.Txn) error {
+		if config.MaxAge > 0 {
+			// Messages are stamped in offset order, stop at the first one young enough
+			oldest := time.Now().Add(-config.MaxAge).UnixNano()
+			ageCut := end
+			err := iterateMessages(txn, topic, first, end, func(offset uint64, message *HLCMsg) error {
+				if message.Physical >= oldest {
+					ageCut = offset
+					return errStopIteration
+				}
+				return nil
+			})
+			if err != nil && err != errStopIteration {
+				return err
+			}
+			if ageCut > cut {
+				cut = ageCut
+			}
+		}
+
+		if config.MaxBytes > 0 || config.MaxMessages > 0 {
+			var count, size int64
+			err := iterateMessageSizes(txn, topic, first, end, func(offset uint64, valueSize int64) error {
+				count++
+				size += valueSize
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			err = iterateMessageSizes(txn, topic, first, end, func(offset uint64, valueSize int64) error {
+				if (config.MaxMessages <= 0 || count <= config.MaxMessages) && (config.MaxBytes <= 0 || size <= config.MaxBytes) {
+					if offset > cut {
+						cut = offset
+					}
+					return errStopIteration
+				}
+				count--
+				size -= valueSize
+				return nil
+			})
+			if err == nil {
+				// Every message is over the limits
+				cut = end
+			} else if err != errStopIteration {
+				return err
+			}
+		}
+		return nil
+	})
+	return cut, err
+}
+
+// Iterate in offset order over the stored size of the messages of a topic
+// with an offset in [from, to), without reading the messages
+func iterateMessageSizes(txn *badger.Txn, topic string, from, to uint64, fn func(offset uint64, valueSize int64) error) error {
+	prefix := messagePrefix(topic)
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Seek(messageKey(topic, from)); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		offset := messageKeyOffset(item.Key())
+		if offset >= to {
+			break
+		}
+		if err := fn(offset, item.ValueSize()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete the stored messages of a topic with an offset in [from, to) together
+// with their index entries, return the number of messages deleted
+func deleteMessages(db *badger.DB, topic string, from, to uint64) (int, error) {
+	deleted := 0
+	for from < to {
+		n := 0
+		err := db.Update(func(txn *badger.Txn) error {
+			var messages []*messageMeta
+			err := iterateMessageMeta(txn, topic, from, to, func(message *messageMeta) error {
+				messages = append(messages, message)
+				if len(messages) == purgeBatchSize {
+					return errStopIteration
+				}
+				return nil
+			})
+			if err != nil && err != errStopIteration {
+				return err
+			}
+			for _, message := range messages {
+				if err := deleteMessage(txn, topic, message); err != nil {
+					return err
+				}
+			}
+			n = len(messages)
+			if n < purgeBatchSize {
+				from = to
+			} else {
+				from = messages[n-1].Offset + 1
+			}
+			return nil
+		})
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+	return deleted, nil
+}
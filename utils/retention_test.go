@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Number of keys of the store starting with prefix
+func countKeys(t *testing.T, db *badger.DB, prefix string) int {
+	t.Helper()
+	n := 0
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(prefix)
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestDeleteMessagesDropsIndexEntries(t *testing.T) {
+	db := openTestDB(t)
+	later := time.Now().Add(time.Hour).UnixNano()
+	messages := []*HLCMsg{
+		{Body: []byte("plain")},
+		{Body: []byte("scheduled"), DeliverAt: later},
+		{Body: []byte("expiring"), ExpiresAt: later},
+		{Body: []byte("both"), DeliverAt: later, ExpiresAt: later},
+		{Body: []byte("kept"), DeliverAt: later, ExpiresAt: later},
+	}
+	if _, err := storeMessages(db, "orders", 0, messages, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := deleteMessages(db, "orders", 0, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 4 {
+		t.Fatalf("deleted %d messages, want 4", deleted)
+	}
+	for prefix, want := range map[string]int{messageKeyPrefix: 1, scheduleKeyPrefix: 1, expiryKeyPrefix: 1} {
+		if n := countKeys(t, db, prefix); n != want {
+			t.Errorf("%d keys left under %s, want %d", n, prefix, want)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package utils
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Messages published with a delivery time are stored right away with the
+// rest of the topic, and indexed until they are due
+//
+//	sched/<topic>\x00<offset>     -> delivery time, unix nanoseconds 8 bytes big endian
+//
+// A consumer reaching a message not due yet skips it and keeps it aside, it
+// gets the message once due.
+const scheduleKeyPrefix = "sched/"
+
+func schedulePrefix(topic string) []byte {
+	return []byte(scheduleKeyPrefix + topic + "\x00")
+}
+
+func scheduleKey(topic string, offset uint64) []byte {
+	return binary.BigEndian.AppendUint64(schedulePrefix(topic), offset)
+}
+
+type scheduledMessage struct {
+	Offset    uint64
+	DeliverAt int64
+}
+
+// Min heap of scheduled messages by delivery time
+type scheduleHeap []scheduledMessage
+
+func (h scheduleHeap) Len() int { return len(h) }
+func (h scheduleHeap) Less(i, j int) bool {
+	if h[i].DeliverAt != h[j].DeliverAt {
+		return h[i].DeliverAt < h[j].DeliverAt
+	}
+	return h[i].Offset < h[j].Offset
+}
+func (h scheduleHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *scheduleHeap) Push(x interface{}) {
+	*h = append(*h, x.(scheduledMessage))
+}
+
+func (h *scheduleHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[0 : n-1]
+	return item
+}
+
+// Scheduled messages of a topic not due yet
+type Schedule struct {
+	mu    sync.Mutex
+	heap  scheduleHeap
+	held  map[uint64]struct{} // Offsets in heap
+	timer *time.Timer         // Fires when the first message is due
+}
+
+func NewSchedule() *Schedule {
+	return &Schedule{
+		held: make(map[uint64]struct{}),
+	}
+}
+
+// Whether the message at offset is not due yet
+func (s *Schedule) Holds(offset uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, held := s.held[offset]
+	return held
+}
+
+func (s *Schedule) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.heap)
+}
+
+// Stop the timer of a schedule whose topic is gone
+func (s *Schedule) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+}
+
+func (s *Schedule) add(offset uint64, deliverAt int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	heap.Push(&s.heap, scheduledMessage{Offset: offset, DeliverAt: deliverAt})
+	s.held[offset] = struct{}{}
+}
+
+// Remove and return the offsets of the messages due at now
+func (s *Schedule) popDue(now int64) []uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []uint64
+	for len(s.heap) > 0 && s.heap[0].DeliverAt <= now {
+		m := heap.Pop(&s.heap).(scheduledMessage)
+		delete(s.held, m.Offset)
+		due = append(due, m.Offset)
+	}
+	return due
+}
+
+// Set the delivery time of the messages of a batch from their delay, a
+// delivery time already passed means right away
+func scheduleMessages(messages []*HLCMsg) {
+	now := time.Now()
+	for _, message := range messages {
+		if message.Delay > 0 {
+			message.DeliverAt = now.Add(message.Delay).UnixNano()
+			message.Delay = 0
+		}
+		if message.DeliverAt <= now.UnixNano() {
+			message.DeliverAt = 0
+		}
+	}
+}
+
+// Arm the timer of a topic schedule for its first message
+func (tm *TopicManager) armSchedule(db *badger.DB, logger *LoggerType, pool *TopicPool) {
+	s := pool.Schedule
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.heap) == 0 {
+		return
+	}
+	wait := time.Until(time.Unix(0, s.heap[0].DeliverAt))
+	if s.timer == nil {
+		s.timer = time.AfterFunc(wait, func() {
+			tm.releaseDue(db, logger, pool)
+		})
+	} else {
+		s.timer.Reset(wait)
+	}
+}
+
+// Hand the messages now due to the consumers that skipped them, and drop them
+// from the schedule index
+func (tm *TopicManager) releaseDue(db *badger.DB, logger *LoggerType, pool *TopicPool) {
+	due := pool.Schedule.popDue(time.Now().UnixNano())
+	if len(due) > 0 {
+		pool.Mutex.RLock()
+		connections := make([]*ConsumerConnection, 0, len(pool.Connections))
+		for _, c := range pool.Connections {
+			connections = append(connections, c)
+		}
+		pool.Mutex.RUnlock()
+
+		for _, c := range connections {
+			c.releaseHeld(due)
+		}
+
+		err := db.Update(func(txn *badger.Txn) error {
+			for _, offset := range due {
+				if err := txn.Delete(scheduleKey(pool.Topic, offset)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			logger.Error("Error removing due messages of topic %s from the schedule: %s", pool.Topic, err)
+		}
+		logger.Info("%d scheduled messages of topic %s are due", len(due), pool.Topic)
+	}
+	tm.armSchedule(db, logger, pool)
+}
+
+// Rebuild the schedules of every topic from the schedule index
+func (tm *TopicManager) loadSchedules(txn *badger.Txn) error {
+	prefix := []byte(scheduleKeyPrefix)
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		key := item.Key()
+		topic := string(key[len(prefix) : len(key)-9])
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		pool := tm.GetOrCreatePool(topic)
+		pool.Schedule.add(messageKeyOffset(key), int64(binary.BigEndian.Uint64(v)))
+	}
+	return nil
+}
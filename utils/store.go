@@ -0,0 +1,327 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Badger key layout
+//
+//	topic/<topic>                 -> TopicMeta
+//	msg/<topic>\x00<offset>       -> HLCMsg, offset is 8 bytes big endian
+//	meta/layout-migrated          -> empty, set once no topic of the old layout is left
+//
+// Every message has its own key so a publish only writes the new messages and
+// the topic record, whatever the size of the topic. Big endian offsets keep the
+// messages of a topic sorted in publish order when iterating.
+const (
+	topicKeyPrefix   = "topic/"
+	messageKeyPrefix = "msg/"
+	metaKeyPrefix    = "meta/"
+)
+
+// Set once topics of the old layout were migrated, so later starts do not
+// look for them
+var layoutMigratedKey = []byte(metaKeyPrefix + "layout-migrated")
+
+// Persisted state of a topic
+type TopicMeta struct {
+	NextOffset uint64 // Offset given to the next message stored in the topic
+}
+
+func topicKey(topic string) []byte {
+	return []byte(topicKeyPrefix + topic)
+}
+
+func messagePrefix(topic string) []byte {
+	return []byte(messageKeyPrefix + topic + "\x00")
+}
+
+func messageKey(topic string, offset uint64) []byte {
+	key := messagePrefix(topic)
+	return binary.BigEndian.AppendUint64(key, offset)
+}
+
+// Offset part of a message key
+func messageKeyOffset(key []byte) uint64 {
+	return binary.BigEndian.Uint64(key[len(key)-8:])
+}
+
+// Returned by an iteration callback to stop early
+var errStopIteration = errors.New("stop iteration")
+
+func encodeGob(v any) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(v); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func decodeGob(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewBuffer(data)).Decode(v)
+}
+
+// Append messages to a topic, in a single transaction together with the topic
+// record, the schedule index and the expiry index. Messages are given consecutive offsets
+// starting at first. If check is set it is given the number of bytes the
+// messages take once encoded, and nothing is stored if it fails. Return the
+// number of bytes stored for the messages.
+func storeMessages(db *badger.DB, topic string, first uint64, messages []*HLCMsg, check func(size int64) error) (int64, error) {
+	var size int64
+	err := db.Update(func(txn *badger.Txn) error {
+		for i, message := range messages {
+			message.Offset = first + uint64(i)
+			message.upgradeContent()
+			enc, err := encodeGob(message)
+			if err != nil {
+				return err
+			}
+			if err := txn.Set(messageKey(topic, message.Offset), enc); err != nil {
+				return err
+			}
+			size += int64(len(enc))
+			if message.DeliverAt > 0 {
+				deliverAt := binary.BigEndian.AppendUint64(nil, uint64(message.DeliverAt))
+				if err := txn.Set(scheduleKey(topic, message.Offset), deliverAt); err != nil {
+					return err
+				}
+			}
+			if message.ExpiresAt > 0 {
+				if err := txn.Set(expiryKey(topic, message.ExpiresAt, message.Offset), nil); err != nil {
+					return err
+				}
+			}
+		}
+		if check != nil {
+			if err := check(size); err != nil {
+				return err
+			}
+		}
+
+		meta, err := encodeGob(&TopicMeta{NextOffset: first + uint64(len(messages))})
+		if err != nil {
+			return err
+		}
+		return txn.Set(topicKey(topic), meta)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// Fields of a stored message needed to sort it out and delete it. Decoding a
+// message into it skips the body.
+type messageMeta struct {
+	Offset    uint64
+	Key       string
+	Tombstone bool
+	Physical  int64
+	DeliverAt int64
+	ExpiresAt int64
+}
+
+// Delete a stored message of a topic with its schedule and expiry index entries
+func deleteMessage(txn *badger.Txn, topic string, message *messageMeta) error {
+	if err := txn.Delete(messageKey(topic, message.Offset)); err != nil {
+		return err
+	}
+	if message.DeliverAt > 0 {
+		if err := txn.Delete(scheduleKey(topic, message.Offset)); err != nil {
+			return err
+		}
+	}
+	if message.ExpiresAt > 0 {
+		return txn.Delete(expiryKey(topic, message.ExpiresAt, message.Offset))
+	}
+	return nil
+}
+
+// Iterate in offset order over the stored messages of a topic with an offset
+// in [from, to)
+func iterateMessages(txn *badger.Txn, topic string, from, to uint64, fn func(offset uint64, message *HLCMsg) error) error {
+	prefix := messagePrefix(topic)
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Seek(messageKey(topic, from)); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		offset := messageKeyOffset(item.Key())
+		if offset >= to {
+			break
+		}
+		err := item.Value(func(v []byte) error {
+			var message HLCMsg
+			if err := decodeGob(v, &message); err != nil {
+				return err
+			}
+			message.Offset = offset
+			message.upgradeContent()
+			return fn(offset, &message)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Iterate in offset order over the metadata of the stored messages of a topic
+// with an offset in [from, to)
+func iterateMessageMeta(txn *badger.Txn, topic string, from, to uint64, fn func(meta *messageMeta) error) error {
+	prefix := messagePrefix(topic)
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Seek(messageKey(topic, from)); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		offset := messageKeyOffset(item.Key())
+		if offset >= to {
+			break
+		}
+		err := item.Value(func(v []byte) error {
+			var meta messageMeta
+			if err := decodeGob(v, &meta); err != nil {
+				return err
+			}
+			meta.Offset = offset
+			return fn(&meta)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// First stored message of a topic with an offset in [from, to), nil if there
+// is none
+func firstMessage(db *badger.DB, topic string, from, to uint64) (*HLCMsg, error) {
+	var first *HLCMsg
+	err := db.View(func(txn *badger.Txn) error {
+		return iterateMessages(txn, topic, from, to, func(offset uint64, message *HLCMsg) error {
+			first = message
+			return errStopIteration
+		})
+	})
+	if err == errStopIteration {
+		err = nil
+	}
+	return first, err
+}
+
+// Read the stored messages of a topic with an offset in [from, to)
+func readMessages(db *badger.DB, topic string, from, to uint64) ([]*HLCMsg, error) {
+	var messages []*HLCMsg
+	err := db.View(func(txn *badger.Txn) error {
+		return iterateMessages(txn, topic, from, to, func(offset uint64, message *HLCMsg) error {
+			messages = append(messages, message)
+			return nil
+		})
+	})
+	return messages, err
+}
+
+// Prefixes of every key of the current layout, anything else is a topic saved
+// with the old layout
+var keyPrefixes = []string{topicKeyPrefix, messageKeyPrefix, subscriptionKeyPrefix, topicConfigKeyPrefix, scheduleKeyPrefix, expiryKeyPrefix, metaKeyPrefix}
+
+// Prefix of the current layout a key starts with, if any
+func layoutPrefix(key []byte) ([]byte, bool) {
+	for _, prefix := range keyPrefixes {
+		if bytes.HasPrefix(key, []byte(prefix)) {
+			return []byte(prefix), true
+		}
+	}
+	return nil, false
+}
+
+// Keys of the topics saved with the old layout. Only keys are read, and the
+// key ranges of the current layout are skipped over.
+func legacyTopics(db *badger.DB) ([]string, error) {
+	var topics []string
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); {
+			k := it.Item().Key()
+			if prefix, ok := layoutPrefix(k); ok {
+				// First key after every key of the prefix, the prefixes end
+				// with '/' so the last byte can not overflow
+				prefix[len(prefix)-1]++
+				it.Seek(prefix)
+				continue
+			}
+			topics = append(topics, string(k))
+			it.Next()
+		}
+		return nil
+	})
+	return topics, err
+}
+
+// Rewrite topics saved with the old layout, where the whole message log of a
+// topic was encoded under the raw topic name. Done once, the store is marked
+// as migrated afterwards.
+func migrateLegacyTopics(db *badger.DB, logger *LoggerType) error {
+	err := db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(layoutMigratedKey)
+		return err
+	})
+	if err == nil {
+		return nil
+	}
+	if err != badger.ErrKeyNotFound {
+		return err
+	}
+
+	topics, err := legacyTopics(db)
+	if err != nil {
+		return err
+	}
+	for _, topic := range topics {
+		var v []byte
+		err := db.View(func(txn *badger.Txn) error {
+			item, err := txn.Get([]byte(topic))
+			if err != nil {
+				return err
+			}
+			v, err = item.ValueCopy(nil)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		q, err := DecodeQueue(v)
+		if err != nil {
+			return err
+		}
+		messages := make([]*HLCMsg, 0, q.heap.Len())
+		for msg := q.GetNextMessage(); msg != nil; msg = q.GetNextMessage() {
+			messages = append(messages, msg)
+		}
+		if _, err := storeMessages(db, topic, 0, messages, nil); err != nil {
+			return err
+		}
+		if err := db.Update(func(txn *badger.Txn) error {
+			return txn.Delete([]byte(topic))
+		}); err != nil {
+			return err
+		}
+		logger.Info("Migrated %d messages of topic %s to the per message layout", len(messages), topic)
+	}
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Set(layoutMigratedKey, nil)
+	})
+}
@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+func TestMigrateLegacyTopics(t *testing.T) {
+	db := openTestDB(t)
+	logger := testLogger()
+
+	legacy := func(topic string, bodies ...string) {
+		t.Helper()
+		q := NewMessageQueue()
+		for _, body := range bodies {
+			q.AddMessage(&HLCMsg{Body: []byte(body)})
+		}
+		v, err := EncodeQueue(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Update(func(txn *badger.Txn) error {
+			return txn.Set([]byte(topic), v)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	legacy("orders", "one", "two")
+	legacy("zeta", "three")
+	// Keys of the current layout are left alone
+	if _, err := storeMessages(db, "current", 0, []*HLCMsg{{Body: []byte("current")}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	topics, err := legacyTopics(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(topics) != 2 || topics[0] != "orders" || topics[1] != "zeta" {
+		t.Fatalf("legacy topics %q, want orders and zeta", topics)
+	}
+	if err := migrateLegacyTopics(db, logger); err != nil {
+		t.Fatal(err)
+	}
+
+	tm := NewTopicManager(logger)
+	tm.LoadPools(db, logger)
+	for topic, want := range map[string]uint64{"orders": 2, "zeta": 1, "current": 1} {
+		pool, exists := tm.GetPool(topic)
+		if !exists || pool.NextOffset != want {
+			t.Fatalf("topic %s loaded %v with %d messages, want %d", topic, exists, pool.NextOffset, want)
+		}
+	}
+	if topics, _ := legacyTopics(db); len(topics) != 0 {
+		t.Fatalf("legacy topics %q left after the migration", topics)
+	}
+
+	// Once migrated the store is not searched again
+	legacy("late", "four")
+	if err := migrateLegacyTopics(db, logger); err != nil {
+		t.Fatal(err)
+	}
+	if topics, _ := legacyTopics(db); len(topics) != 1 {
+		t.Fatalf("legacy topics %q, the migration ran again", topics)
+	}
+}
@@ -0,0 +1,373 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Durable subscriptions remember the position of a named consumer in badger
+//
+//	sub/<topic>\x00<name>         -> SubscriptionState
+//
+// so the consumer resumes right after its last acknowledged message when it
+// connects again with the same name.
+const subscriptionKeyPrefix = "sub/"
+
+var (
+	ErrSubscriptionInUse   = errors.New("subscription is in use by a connected consumer")
+	ErrUnknownSubscription = errors.New("subscription does not exist")
+)
+
+// Persisted state of a durable subscription or consumer group
+type SubscriptionState struct {
+	NextOffset uint64   // Offset of the first message not acknowledged yet, scheduled messages aside
+	Delayed    []uint64 // Scheduled messages before NextOffset not acknowledged yet
+	Group      bool
+}
+
+// Durable subscription or consumer group as reported to admin clients
+type SubscriptionInfo struct {
+	Topic      string
+	Name       string
+	NextOffset uint64
+	Lag        uint64 // Number of messages stored after NextOffset - 1
+	Connected  bool
+	Group      bool
+	Members    int // Number of connected members of a consumer group
+}
+
+func subscriptionPrefix(topic string) []byte {
+	return []byte(subscriptionKeyPrefix + topic + "\x00")
+}
+
+func subscriptionKey(topic, name string) []byte {
+	return append(subscriptionPrefix(topic), name...)
+}
+
+func loadSubscription(db *badger.DB, topic, name string) (*SubscriptionState, error) {
+	var state SubscriptionState
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(subscriptionKey(topic, name))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(v []byte) error {
+			return decodeGob(v, &state)
+		})
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrUnknownSubscription
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func saveSubscription(db *badger.DB, topic, name string, state *SubscriptionState) error {
+	enc, err := encodeGob(state)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Set(subscriptionKey(topic, name), enc)
+	})
+}
+
+// Find the connection of a durable subscription or group, must be called with
+// the pool mutex held
+func (pool *TopicPool) durableConnection(name string) *ConsumerConnection {
+	for _, c := range pool.Connections {
+		if c.Subscription == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Subscribe a consumer under a durable subscription name. The subscription
+// resumes from its stored position. A new one starts at the beginning of the
+// topic if replay is set, or at the end of it otherwise. Only one consumer can
+// be connected to a durable subscription at a time. If the retention policy
+// deleted the stored position, the consumer is subscribed from the oldest
+// message left and an ErrPositionDeleted error tells the messages it missed.
+func (tm *TopicManager) SubscribeDurable(db *badger.DB, topic, name, consumerId string, conn net.Conn, replay bool) error {
+	pool, err := tm.lockPool(topic)
+	if err != nil {
+		return err
+	}
+	defer pool.Mutex.Unlock()
+
+	if pool.durableConnection(name) != nil {
+		return ErrSubscriptionInUse
+	}
+	if err := tm.checkSubscriptions(pool); err != nil {
+		return err
+	}
+
+	state, moved := pool.openSubscription(db, name, replay, false)
+	if moved != nil && !errors.Is(moved, ErrPositionDeleted) {
+		return moved
+	}
+
+	c := newConsumerConnection(consumerId, conn, state.NextOffset)
+	c.Subscription = name
+	c.attempts = pool.subscriptionAttempts(name)
+	if err := c.restoreDelayed(db, topic, state.Delayed, pool.Schedule); err != nil {
+		return err
+	}
+	pool.Connections[consumerId] = c
+	return moved
+}
+
+// Load the stored state of a durable subscription or group, or create it. A
+// stored position deleted by the retention policy moves to the oldest message
+// left, together with an ErrPositionDeleted error. Must be called with the
+// pool mutex held.
+func (pool *TopicPool) openSubscription(db *badger.DB, name string, replay, group bool) (*SubscriptionState, error) {
+	state, err := loadSubscription(db, pool.Topic, name)
+	if err == ErrUnknownSubscription {
+		state = &SubscriptionState{NextOffset: pool.NextOffset, Group: group}
+		if replay {
+			state.NextOffset = pool.FirstOffset
+		}
+		err = saveSubscription(db, pool.Topic, name, state)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if state.NextOffset < pool.FirstOffset {
+		// Reported once, the next consumer resumes from the new position
+		moved := fmt.Errorf("stored position %d of %s: %w", state.NextOffset, name, positionDeleted(pool.FirstOffset))
+		state.NextOffset = pool.FirstOffset
+		state.Delayed = nil
+		if err := saveSubscription(db, pool.Topic, name, state); err != nil {
+			return nil, err
+		}
+		return state, moved
+	}
+	return state, nil
+}
+
+// Sends of the messages of a subscription not acknowledged yet. The pool keeps
+// them for durable subscriptions and groups, so the attempts add up across
+// reconnects and a message failing every consumer reaches its dead letter
+// topic.
+type deliveryAttempts struct {
+	mu     sync.Mutex
+	counts map[uint64]int
+}
+
+func newDeliveryAttempts() *deliveryAttempts {
+	return &deliveryAttempts{counts: make(map[uint64]int)}
+}
+
+// Count a send of the message at offset and return its attempt
+func (a *deliveryAttempts) add(offset uint64) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.counts[offset]++
+	return a.counts[offset]
+}
+
+func (a *deliveryAttempts) forget(offset uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.counts, offset)
+}
+
+func (a *deliveryAttempts) reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	clear(a.counts)
+}
+
+// Delivery attempts of a durable subscription or group, must be called with
+// the pool mutex held
+func (pool *TopicPool) subscriptionAttempts(name string) *deliveryAttempts {
+	attempts, exists := pool.attempts[name]
+	if !exists {
+		attempts = newDeliveryAttempts()
+		pool.attempts[name] = attempts
+	}
+	return attempts
+}
+
+// Record a message as sent to a consumer, it stays in flight until it is
+// acknowledged or released. Return the delivery attempt of the message,
+// counting the sends to every member of a group and to the consumers
+// connected before under the same durable subscription.
+func (tm *TopicManager) Delivered(topic, consumerId string, message *HLCMsg) int {
+	_, c, exists := tm.GetConnection(topic, consumerId)
+	if !exists {
+		return 1
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.inflight[message.Offset] = message
+	return c.attempts.add(message.Offset)
+}
+
+// Acknowledge a message in flight. For a durable subscription or a group, the
+// first offset not acknowledged yet is stored whenever it moves forward.
+func (tm *TopicManager) Acknowledge(db *badger.DB, topic, consumerId string, offset uint64) error {
+	_, c, exists := tm.GetConnection(topic, consumerId)
+	if !exists {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.inflight, offset)
+	c.attempts.forget(offset)
+	delayed := c.delayed[offset]
+	delete(c.delayed, offset)
+	if c.Subscription == "" {
+		return nil
+	}
+	committed := c.committedOffset()
+	if committed > c.committed {
+		c.committed = committed
+	} else if !delayed || offset >= c.committed {
+		return nil
+	}
+	return c.saveState(db, topic)
+}
+
+// Put a message in flight back in the pending messages, for it to be sent
+// again to the consumer or to another member of its group
+func (tm *TopicManager) Release(topic, consumerId string, message *HLCMsg) {
+	_, c, exists := tm.GetConnection(topic, consumerId)
+	if !exists {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, inflight := c.inflight[message.Offset]; !inflight {
+		return
+	}
+	delete(c.inflight, message.Offset)
+	c.PendingMessage.AddMessage(message)
+}
+
+// List the durable subscriptions of a topic, or of every topic if topic is empty
+func (tm *TopicManager) ListSubscriptions(db *badger.DB, topic string) ([]SubscriptionInfo, error) {
+	prefix := []byte(subscriptionKeyPrefix)
+	if topic != "" {
+		prefix = subscriptionPrefix(topic)
+	}
+
+	var subs []SubscriptionInfo
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			var state SubscriptionState
+			if err := item.Value(func(v []byte) error {
+				return decodeGob(v, &state)
+			}); err != nil {
+				return err
+			}
+
+			key := string(item.Key()[len(subscriptionKeyPrefix):])
+			if topic, name, ok := strings.Cut(key, "\x00"); ok {
+				subs = append(subs, SubscriptionInfo{
+					Topic:      topic,
+					Name:       name,
+					NextOffset: state.NextOffset,
+					Group:      state.Group,
+				})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range subs {
+		sub := &subs[i]
+		pool, exists := tm.GetPool(sub.Topic)
+		if !exists {
+			continue
+		}
+		pool.Mutex.RLock()
+		sub.Connected = pool.durableConnection(sub.Name) != nil
+		if g, exists := pool.Groups[sub.Name]; exists {
+			sub.Members = len(g.Members)
+		}
+		if pool.NextOffset > sub.NextOffset {
+			sub.Lag = pool.NextOffset - sub.NextOffset
+		}
+		pool.Mutex.RUnlock()
+	}
+	return subs, nil
+}
+
+// Move a durable subscription to the given offset, the next consumer to
+// connect with it starts from there. The offset can not be before the oldest
+// message left by the retention policy.
+func (tm *TopicManager) ResetSubscription(db *badger.DB, topic, name string, offset uint64) error {
+	pool, exists := tm.GetPool(topic)
+	if !exists {
+		return ErrUnknownSubscription
+	}
+
+	pool.Mutex.Lock()
+	defer pool.Mutex.Unlock()
+
+	if pool.durableConnection(name) != nil {
+		return ErrSubscriptionInUse
+	}
+	if offset < pool.FirstOffset {
+		return positionDeleted(pool.FirstOffset)
+	}
+	state, err := loadSubscription(db, topic, name)
+	if err != nil {
+		return err
+	}
+	state.NextOffset = offset
+	state.Delayed = nil
+	if attempts, exists := pool.attempts[name]; exists {
+		attempts.reset()
+	}
+	return saveSubscription(db, topic, name, state)
+}
+
+// Forget a durable subscription and its position
+func (tm *TopicManager) DeleteSubscription(db *badger.DB, topic, name string) error {
+	pool, exists := tm.GetPool(topic)
+	if !exists {
+		return ErrUnknownSubscription
+	}
+
+	pool.Mutex.Lock()
+	defer pool.Mutex.Unlock()
+
+	if pool.durableConnection(name) != nil {
+		return ErrSubscriptionInUse
+	}
+	if _, err := loadSubscription(db, topic, name); err != nil {
+		return err
+	}
+	delete(pool.attempts, name)
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(subscriptionKey(topic, name))
+	})
+}
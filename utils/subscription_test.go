@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+)
+
+// A durable subscription whose stored position was deleted resumes from the
+// oldest message left and says so
+func TestSubscribeDurablePositionDeleted(t *testing.T) {
+	db := openTestDB(t)
+	logger := testLogger()
+	tm := NewTopicManager(logger)
+	messages := make([]*HLCMsg, 5)
+	for i := range messages {
+		messages[i] = &HLCMsg{Body: []byte("old")}
+	}
+	if err := tm.PublishMessages(db, logger, "orders", messages); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveSubscription(db, "orders", "billing", &SubscriptionState{NextOffset: 1}); err != nil {
+		t.Fatal(err)
+	}
+	pool, _ := tm.GetPool("orders")
+	if _, err := deleteMessages(db, "orders", 0, 3); err != nil {
+		t.Fatal(err)
+	}
+	pool.Mutex.Lock()
+	pool.FirstOffset = 3
+	pool.Mutex.Unlock()
+
+	err := tm.SubscribeDurable(db, "orders", "billing", "c1", nil, false)
+	if !errors.Is(err, ErrPositionDeleted) {
+		t.Fatalf("subscribed with error %v, want the position deleted", err)
+	}
+	_, c, exists := tm.GetConnection("orders", "c1")
+	if !exists {
+		t.Fatal("consumer not subscribed")
+	}
+	if c.NextOffset != 3 {
+		t.Fatalf("subscription resumed at offset %d, want 3", c.NextOffset)
+	}
+
+	// A position still stored resumes quietly
+	tm.UnsubscribeConsumer("orders", "c1")
+	if err := tm.SubscribeDurable(db, "orders", "billing", "c2", nil, false); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,163 @@
+package utils
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Settings of a topic are stored apart from its messages
+//
+//	config/<topic>                -> TopicConfig
+//
+// so publishing never rewrites them. A topic can be configured before its
+// first message is published.
+const topicConfigKeyPrefix = "config/"
+
+var ErrUnknownTopic = errors.New("topic does not exist")
+
+// Sends of a message without ack after which the consumer is dropped, on a
+// topic without MaxDeliveryAttempts
+const DefaultMaxDeliveryAttempts = 10
+
+// Settings of a topic
+type TopicConfig struct {
+	MaxDeliveryAttempts int           // Failed deliveries before a message is moved to the dead letter topic, 0 disables dead lettering and drops the consumer after DefaultMaxDeliveryAttempts instead
+	DeadLetterTopic     string        // Topic dead lettered messages go to, <topic>.DLQ if empty
+	DefaultTTL          time.Duration // Time to live of the messages published without one, 0 for no expiry
+	MaxAge              time.Duration // Messages older than this are deleted, 0 to keep them forever
+	MaxBytes            int64         // The oldest messages are deleted while the topic stores more bytes than this, 0 for no limit
+	MaxMessages         int64         // The oldest messages are deleted while the topic holds more messages than this, 0 for no limit
+	Compacted           bool          // Only the newest message of each key is kept, every message needs a key
+	TombstoneRetention  time.Duration // How long a tombstone stays in a compacted topic, DefaultTombstoneRetention if 0
+}
+
+// Topic dead lettered messages of the given topic go to
+func (c *TopicConfig) DeadLetterTopicFor(topic string) string {
+	if c.DeadLetterTopic != "" {
+		return c.DeadLetterTopic
+	}
+	return topic + ".DLQ"
+}
+
+// Sends of a message without ack after which the message is given up on
+func (c *TopicConfig) DeliveryAttempts() int {
+	if c.MaxDeliveryAttempts > 0 {
+		return c.MaxDeliveryAttempts
+	}
+	return DefaultMaxDeliveryAttempts
+}
+
+func topicConfigKey(topic string) []byte {
+	return []byte(topicConfigKeyPrefix + topic)
+}
+
+func saveTopicConfig(db *badger.DB, topic string, config *TopicConfig) error {
+	enc, err := encodeGob(config)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Set(topicConfigKey(topic), enc)
+	})
+}
+
+// Create the pools of the configured topics and set their config
+func (tm *TopicManager) loadTopicConfigs(txn *badger.Txn) error {
+	prefix := []byte(topicConfigKeyPrefix)
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		var config TopicConfig
+		if err := item.Value(func(v []byte) error {
+			return decodeGob(v, &config)
+		}); err != nil {
+			return err
+		}
+		pool := tm.GetOrCreatePool(string(item.Key()[len(prefix):]))
+		pool.Config = config
+	}
+	return nil
+}
+
+// Current config of a topic
+func (tm *TopicManager) TopicConfig(topic string) (TopicConfig, error) {
+	pool, exists := tm.GetPool(topic)
+	if !exists {
+		return TopicConfig{}, ErrUnknownTopic
+	}
+
+	pool.Mutex.RLock()
+	defer pool.Mutex.RUnlock()
+
+	return pool.Config, nil
+}
+
+// Replace the config of a topic, the topic is created if it does not exist
+func (tm *TopicManager) SetTopicConfig(db *badger.DB, topic string, config TopicConfig) error {
+	pool, err := tm.lockPool(topic)
+	if err != nil {
+		return err
+	}
+	defer pool.Mutex.Unlock()
+
+	if err := saveTopicConfig(db, topic, &config); err != nil {
+		return err
+	}
+	pool.Config = config
+	return nil
+}
+
+// Counters of a topic as reported to admin clients
+type TopicStats struct {
+	Topic            string
+	FirstOffset      uint64 // Messages before it were deleted by the retention policy
+	NextOffset       uint64
+	StoredBytes      int64  // Size of the stored messages
+	Scheduled        int    // Messages not due yet
+	ExpiredDropped   uint64 // Expired messages skipped instead of being delivered, counted once per consumer
+	ExpiredPurged    uint64 // Expired messages deleted from the store
+	RetentionDeleted uint64 // Messages deleted by the retention policy
+	Compacted        uint64 // Messages replaced by a newer one of the same key, and tombstones past their retention
+}
+
+// Counters of a topic, or of every topic if topic is empty
+func (tm *TopicManager) TopicStats(topic string) ([]TopicStats, error) {
+	var pools []*TopicPool
+	if topic != "" {
+		pool, exists := tm.GetPool(topic)
+		if !exists {
+			return nil, ErrUnknownTopic
+		}
+		pools = append(pools, pool)
+	} else {
+		tm.Mutex.RLock()
+		for _, pool := range tm.Pools {
+			pools = append(pools, pool)
+		}
+		tm.Mutex.RUnlock()
+	}
+
+	stats := make([]TopicStats, 0, len(pools))
+	for _, pool := range pools {
+		pool.Mutex.RLock()
+		firstOffset, nextOffset, storedBytes := pool.FirstOffset, pool.NextOffset, pool.StoredBytes
+		pool.Mutex.RUnlock()
+		stats = append(stats, TopicStats{
+			Topic:            pool.Topic,
+			FirstOffset:      firstOffset,
+			NextOffset:       nextOffset,
+			StoredBytes:      storedBytes,
+			Scheduled:        pool.Schedule.Len(),
+			ExpiredDropped:   pool.expiry.dropped.Load(),
+			ExpiredPurged:    pool.expiry.purged.Load(),
+			RetentionDeleted: pool.retentionDeleted.Load(),
+			Compacted:        pool.compacted.Load(),
+		})
+	}
+	return stats, nil
+}
@@ -0,0 +1,62 @@
+package utils
+
+// Default number of most recent messages of a topic kept in memory
+const DefaultHotTailSize = 1000
+
+// Hot tail of a topic log, only the most recent messages are kept in memory
+// and older ones are read back from badger. messages[i] has offset First+i.
+// Guarded by the mutex of the topic pool it belongs to.
+type TopicLog struct {
+	messages []*HLCMsg
+	First    uint64 // Offset of the oldest message in memory
+	capacity int
+}
+
+func NewTopicLog(capacity int, first uint64) *TopicLog {
+	return &TopicLog{
+		First:    first,
+		capacity: capacity,
+	}
+}
+
+// Offset right after the newest message of the tail
+func (l *TopicLog) End() uint64 {
+	return l.First + uint64(len(l.messages))
+}
+
+// Append messages stored at offset End() onwards, the oldest messages are
+// dropped once the tail is over capacity
+func (l *TopicLog) Append(messages ...*HLCMsg) {
+	l.messages = append(l.messages, messages...)
+	if over := len(l.messages) - l.capacity; over > 0 {
+		for i := 0; i < over; i++ {
+			l.messages[i] = nil
+		}
+		l.messages = l.messages[over:]
+		l.First += uint64(over)
+	}
+}
+
+// Copies of the messages in [from, to), ok is false if part of the range is
+// no longer in memory. Removed messages are skipped.
+func (l *TopicLog) Range(from, to uint64) (messages []*HLCMsg, ok bool) {
+	if from < l.First || to > l.End() {
+		return nil, false
+	}
+	messages = make([]*HLCMsg, 0, to-from)
+	for _, msg := range l.messages[from-l.First : to-l.First] {
+		if msg != nil {
+			messages = append(messages, msg.DeepCopy())
+		}
+	}
+	return messages, true
+}
+
+// Forget the messages at the given offsets, they were deleted from the store
+func (l *TopicLog) Remove(offsets []uint64) {
+	for _, offset := range offsets {
+		if offset >= l.First && offset < l.End() {
+			l.messages[offset-l.First] = nil
+		}
+	}
+}